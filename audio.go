@@ -1,6 +1,8 @@
 package main
 
 import (
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gopxl/beep"
@@ -8,16 +10,32 @@ import (
 )
 
 const SPEAKER_BUFFER_MILLISECONDS = 100
+
+// Sample rate of the audio output if not set by the user
+const DEFAULT_SAMPLE_RATE = 48000
 const MAX_AUDIO_DESYNC_MILLISECONDS = 20
 
+// How much the audio delay keys change the delay
+const AUDIO_DELAY_STEP = 50 * time.Millisecond
+
+// Changes of the audio delay are applied in steps of at most this size,
+// so that the audio doesn't jump
+const AUDIO_DELAY_ADJUST_MILLISECONDS = 10
+
 type AudioFrame [][2]float64
 type AudioPlayer struct {
 	// Whether the audio player is playing a file or not
 	isPlaying bool
 	// The input channel for audio frames
 	input chan *AudioFrame
-	// The thing that actually plays the audio
-	streamer *AudioStreamer
+	// The thing that actually plays the audio.
+	// Atomic, as the loader reads it when seeking.
+	streamer atomic.Pointer[AudioStreamer]
+	// Volume applied to the audio, kept between files
+	volume *Volume
+	// How much later the audio is played than the video, kept between files.
+	// Stored as a time.Duration, as it is read by the speaker goroutine.
+	delay atomic.Int64
 	// Provides access to timing information
 	timer *Timer
 	// Context for communication with the main goroutine
@@ -41,22 +59,102 @@ type AudioStreamer struct {
 	speakerBufferSize int
 	desyncTolerance   int
 	pctx              *PlayerContext
+	// Changes the speed of the audio when it isn't played at normal speed
+	stretcher *timeStretcher
+	// The audio delay set by the user
+	delay *atomic.Int64
+	// The audio delay that the position is currently synchronized to,
+	// which follows `delay` in small steps.
+	// Both are real time, the delay that is heard doesn't depend on the speed.
+	appliedDelay time.Duration
+
+	// A seek that will be executed on the next call to Stream
+	pendingSeek *time.Duration
+	// Guards `pendingSeek`, which is set from outside the speaker goroutine
+	seekMu sync.Mutex
+}
+
+// Moves the streamer to `pos` on the next call to Stream.
+// The speaker lock can't be used here, because Stream may hold it
+// while waiting for the loader, which is the one seeking.
+func (a *AudioStreamer) seek(pos time.Duration) {
+	a.seekMu.Lock()
+	defer a.seekMu.Unlock()
+	a.pendingSeek = &pos
+}
+
+// Executes a pending seek, if there is one.
+// The current frame is discarded as it belongs to the old position.
+func (a *AudioStreamer) applyPendingSeek() {
+	a.seekMu.Lock()
+	defer a.seekMu.Unlock()
+	if a.pendingSeek == nil {
+		return
+	}
+	a.pos = a.sampleRate.N(*a.pendingSeek)
+	a.currentFrame = nil
+	a.currentFramePos = 0
+	a.pendingSeek = nil
+	a.stretcher.reset()
 }
 
 // Calculate the desync between the audio streamer and the timer.
 // You can interpret this number as by how much the streamer position is shifted compared to the timer,
 // eg. if the streamer is ahead by 10 samples, the desync is 10.
 //
+// The time spent paused is not counted and the speed is taken into account, see `Timer.Position`.
+// The audio is meant to be behind the timer by the applied audio delay, played at `speed`.
+//
 // @returns the number of samples the audio streamer is behind.
 // A positive number means the audio streamer is ahead of the timer by that many samples.
 // A negative number means the audio streamer is behind the timer by that many samples.
-func (a *AudioStreamer) calcDesync() int {
-	passedTime := time.Since(a.timer.startTime)
+func (a *AudioStreamer) calcDesync(speed float64) int {
+	passedTime := a.timer.Position() - atSpeed(a.appliedDelay, speed)
 	targetPos := beep.SampleRate(a.sampleRate).N(passedTime)
 
 	return a.pos - targetPos
 }
 
+// Converts real time to the amount of media that is played in it at `speed`
+func atSpeed(d time.Duration, speed float64) time.Duration {
+	return time.Duration(float64(d) * speed)
+}
+
+// Returns how much the applied audio delay moves towards the one set by the user next.
+// Once playback started, it moves in steps of `AUDIO_DELAY_ADJUST_MILLISECONDS`.
+func (a *AudioStreamer) nextDelayChange() time.Duration {
+	change := time.Duration(a.delay.Load()) - a.appliedDelay
+	if a.currentFrame != nil {
+		maxChange := AUDIO_DELAY_ADJUST_MILLISECONDS * time.Millisecond
+		change = min(max(change, -maxChange), maxChange)
+	}
+	return change
+}
+
+// Moves the applied audio delay towards the one set by the user.
+// A longer delay is applied by playing silence and a shorter one by skipping samples.
+// The samples are played `speed` times as fast, so `speed` times as many are needed for the same delay.
+// @param maxSilence the number of samples of silence that can be played
+// @returns the number of samples of silence to play and whether any more frames are available
+func (a *AudioStreamer) applyDelayChange(maxSilence int, speed float64) (silence int, ok bool) {
+	change := a.nextDelayChange()
+	if change == 0 {
+		return 0, true
+	}
+
+	if change > 0 {
+		silence = a.sampleRate.N(atSpeed(change, speed))
+		if silence > maxSilence {
+			silence = maxSilence
+			change = time.Duration(float64(a.sampleRate.D(silence)) / speed)
+		}
+		a.appliedDelay += change
+		return silence, true
+	}
+	a.appliedDelay += change
+	return 0, a.skipAhead(a.sampleRate.N(atSpeed(-change, speed)))
+}
+
 // Return whether the audio streamer needs a new frame.
 // This can be either because no frame has been loaded yet (initial state),
 // or because the current frame has been fully read.
@@ -147,10 +245,65 @@ func (a *AudioStreamer) Stream(samples [][2]float64) (n int, ok bool) {
 	logger.Debug("audioPlayer", "Samples requested")
 	defer logger.Debug("audioPlayer", "Samples provided")
 
-	desync := a.calcDesync()
+	a.applyPendingSeek()
+
+	if a.timer.IsPaused() {
+		// Output silence without advancing the position,
+		// so that playback resumes where it was paused
+		clear(samples)
+		return len(samples), true
+	}
+
+	speed := a.timer.Speed()
+	source := a.streamSynced
+	if syncMode == SYNC_AUDIO {
+		a.syncTimer(speed)
+		source = a.streamContinuous
+	}
+
+	if speed == 1 {
+		// Play the samples unchanged
+		a.stretcher.reset()
+		n, ok = source(samples, speed)
+	} else {
+		n, ok = a.stretcher.stretch(samples, speed, func(input AudioFrame) (int, bool) {
+			return source(input, speed)
+		})
+	}
+
+	a.pctx.playedSamples.Write(samples[:n])
+	return n, ok
+}
+
+// Moves the timer to the position of the audio that is currently heard,
+// when the audio is the master clock
+func (a *AudioStreamer) syncTimer(speed float64) {
+	// Samples that were read but are still waiting in the stretcher or the speaker buffer
+	queued := a.stretcher.buffered() + int(float64(a.speakerBufferSize)*speed)
+	heard := a.sampleRate.D(max(a.pos-queued, 0))
+	// The video is shown later if the audio is delayed.
+	// Delay changes are applied in steps, so that the video doesn't jump.
+	a.appliedDelay += a.nextDelayChange()
+	a.timer.SyncTo(heard+atSpeed(a.appliedDelay, speed), a.sampleRate.D(a.desyncTolerance))
+}
+
+// Fills the samples buffer without skipping or waiting,
+// when the audio is the master clock and the timer follows it
+// @returns the number of samples loaded and whether more samples are available
+func (a *AudioStreamer) streamContinuous(samples AudioFrame, speed float64) (n int, ok bool) {
+	return a.loadBufferStartingAt(0, samples)
+}
+
+// Fills the samples buffer with the samples at the position of the timer,
+// skipping ahead or waiting if the audio is out of sync
+// @returns the number of samples loaded and whether more samples are available
+func (a *AudioStreamer) streamSynced(samples AudioFrame, speed float64) (n int, ok bool) {
+	desync := a.calcDesync(speed)
 
 	behindTolerance := a.desyncTolerance
-	aheadTolerance := a.desyncTolerance + a.speakerBufferSize // allow for the speaker buffer to fill
+	// Allow for the speaker buffer to fill, which is consumed `speed` times as fast,
+	// and for the samples held by the stretcher
+	aheadTolerance := a.desyncTolerance + int(float64(a.speakerBufferSize)*speed) + a.stretcher.buffered()
 
 	logger.Info("audioPlayer", "Audio desync: %d, tolerance %d/%d", desync, -behindTolerance, aheadTolerance)
 
@@ -169,7 +322,19 @@ func (a *AudioStreamer) Stream(samples [][2]float64) (n int, ok bool) {
 	samplesAhead = max(min(samplesAhead, len(samples)), 0)              // clamp between 0 and len(samples)
 	samplesAhead = tern(samplesAhead > aheadTolerance, samplesAhead, 0) // allow for tolerance
 
-	return a.loadBufferStartingAt(samplesAhead, samples)
+	silence, ok := a.applyDelayChange(len(samples)-samplesAhead, speed)
+	if !ok {
+		return 0, false
+	}
+	samplesAhead += silence
+	clear(samples[:samplesAhead])
+
+	n, ok = a.loadBufferStartingAt(samplesAhead, samples)
+	if !ok {
+		return 0, false
+	}
+	// The silence in front counts as well
+	return samplesAhead + n, true
 }
 
 // Err function for the beep.Streamer interface
@@ -177,11 +342,43 @@ func (a *AudioStreamer) Err() error {
 	return a.err
 }
 
+// The speaker can't be reinitialized cleanly,
+// so it is initialized once and plays every file with the same sample rate
+var (
+	speakerInitOnce   sync.Once
+	speakerInitErr    error
+	speakerSampleRate beep.SampleRate
+)
+
+// Initializes the speaker on the first call
+// @returns an error if the speaker was initialized with a different sample rate
+func initSpeaker(sampleRate beep.SampleRate, bufferSize int) error {
+	speakerInitOnce.Do(func() {
+		logger.Info("audioPlayer", "Initializing speaker with %d Hz", sampleRate)
+		if err := speaker.Init(sampleRate, bufferSize); err != nil {
+			speakerInitErr = taggedErrf("audioPlayer", "failed to initialize speaker: %w", err)
+			return
+		}
+		speakerSampleRate = sampleRate
+	})
+
+	if speakerInitErr != nil {
+		return speakerInitErr
+	}
+	if sampleRate != speakerSampleRate {
+		return taggedErrf("audioPlayer", "audio has a sample rate of %d Hz, but the speaker was initialized with %d Hz", sampleRate, speakerSampleRate)
+	}
+	return nil
+}
+
 func NewAudioPlayer(pctx *PlayerContext) *AudioPlayer {
-	return &AudioPlayer{
+	a := &AudioPlayer{
 		pctx:      pctx,
 		isPlaying: false,
+		volume:    NewVolume(userVolume, startMuted),
 	}
+	a.delay.Store(int64(userAudioDelay))
+	return a
 }
 
 func (a *AudioPlayer) Start(sampleRate int) error {
@@ -193,7 +390,7 @@ func (a *AudioPlayer) Start(sampleRate int) error {
 	a.isPlaying = true
 
 	bSampleRate := beep.SampleRate(sampleRate)
-	a.streamer = &AudioStreamer{
+	streamer := &AudioStreamer{
 		sampleRate:        bSampleRate,
 		timer:             a.timer,
 		err:               nil,
@@ -202,16 +399,19 @@ func (a *AudioPlayer) Start(sampleRate int) error {
 		pctx:              a.pctx,
 		speakerBufferSize: bSampleRate.N(time.Millisecond * SPEAKER_BUFFER_MILLISECONDS),
 		desyncTolerance:   bSampleRate.N(time.Millisecond * MAX_AUDIO_DESYNC_MILLISECONDS),
+		stretcher:         newTimeStretcher(sampleRate),
+		delay:             &a.delay,
+		appliedDelay:      0,
 	}
+	a.streamer.Store(streamer)
 
-	err := speaker.Init(bSampleRate, a.streamer.speakerBufferSize)
-	if err != nil {
-		return taggedErrf("audioPlayer", "failed to initialize speaker: %w", err)
+	if err := initSpeaker(bSampleRate, streamer.speakerBufferSize); err != nil {
+		return err
 	}
 
 	done := make(chan struct{})
 
-	speaker.Play(beep.Seq(a.streamer, beep.Callback(func() {
+	speaker.Play(beep.Seq(&volumeStreamer{streamer: streamer, volume: a.volume}, beep.Callback(func() {
 		close(done)
 	})))
 
@@ -230,8 +430,21 @@ func (a *AudioPlayer) Start(sampleRate int) error {
 	return nil
 }
 
+// ChangeDelay changes how much later the audio is played than the video by `delta`
+// @returns the new delay
+func (a *AudioPlayer) ChangeDelay(delta time.Duration) time.Duration {
+	return time.Duration(a.delay.Add(int64(delta)))
+}
+
+// Seek moves the audio player to `pos`
+func (a *AudioPlayer) Seek(pos time.Duration) {
+	if streamer := a.streamer.Load(); streamer != nil {
+		streamer.seek(pos)
+	}
+}
+
 func (a *AudioPlayer) Close() {
 	speaker.Clear()
 	a.isPlaying = false
-	a.streamer = nil
+	a.streamer.Store(nil)
 }
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"runtime"
+	"strings"
+	"sync/atomic"
+)
+
+// How many colors the terminal supports
+type ColorDepth int
+
+const (
+	COLOR_DEPTH_TRUECOLOR ColorDepth = iota // 24-bit RGB colors
+	COLOR_DEPTH_256                         // The xterm 256 color palette
+	COLOR_DEPTH_16                          // The 16 standard ANSI colors
+)
+
+var colorDepth ColorDepth
+
+// Guesses the color depth of the terminal from the environment
+func detectColorDepth() ColorDepth {
+	colorTerm := strings.ToLower(os.Getenv("COLORTERM"))
+	if colorTerm == "truecolor" || colorTerm == "24bit" {
+		return COLOR_DEPTH_TRUECOLOR
+	}
+
+	term := strings.ToLower(os.Getenv("TERM"))
+	switch {
+	case strings.Contains(term, "direct") || strings.Contains(term, "truecolor") || term == "xterm-kitty":
+		return COLOR_DEPTH_TRUECOLOR
+	case strings.Contains(term, "256"):
+		return COLOR_DEPTH_256
+	case term == "" && runtime.GOOS == "windows":
+		// Windows Terminal and recent consoles support truecolor, but don't set TERM
+		return COLOR_DEPTH_TRUECOLOR
+	default:
+		return COLOR_DEPTH_16
+	}
+}
+
+// A color in the CIELAB color space,
+// in which euclidean distance roughly matches perceived difference
+type labColor struct {
+	l, a, b float64
+}
+
+// Converts a 0-255 sRGB color to CIELAB with the D65 white point
+func rgbToLab(r, g, b uint8) labColor {
+	linear := func(c uint8) float64 {
+		v := float64(c) / 255
+		if v <= 0.04045 {
+			return v / 12.92
+		}
+		return math.Pow((v+0.055)/1.055, 2.4)
+	}
+	lr, lg, lb := linear(r), linear(g), linear(b)
+
+	x := (0.4124*lr + 0.3576*lg + 0.1805*lb) / 0.95047
+	y := (0.2126*lr + 0.7152*lg + 0.0722*lb) / 1.00000
+	z := (0.0193*lr + 0.1192*lg + 0.9505*lb) / 1.08883
+
+	f := func(t float64) float64 {
+		if t > 216.0/24389 {
+			return math.Cbrt(t)
+		}
+		return (24389.0/27*t + 16) / 116
+	}
+	fx, fy, fz := f(x), f(y), f(z)
+
+	return labColor{
+		l: 116*fy - 16,
+		a: 500 * (fx - fy),
+		b: 200 * (fy - fz),
+	}
+}
+
+func (c labColor) distance(o labColor) float64 {
+	dl, da, db := c.l-o.l, c.a-o.a, c.b-o.b
+	return dl*dl + da*da + db*db
+}
+
+// An entry of a terminal color palette
+type paletteColor struct {
+	index   int
+	r, g, b uint8
+	lab     labColor
+}
+
+// A terminal color palette with a cache for the nearest color lookup
+type palette struct {
+	colors []paletteColor
+	// Nearest palette index for every color quantized to 5 bits per channel,
+	// -1 if not calculated yet.
+	// It is used by the converter and the video player at the same time.
+	cache []atomic.Int32
+}
+
+// Number of bits per channel used as the key of the palette cache
+const PALETTE_CACHE_BITS = 5
+
+func newPalette(colors []paletteColor) *palette {
+	for i := range colors {
+		colors[i].lab = rgbToLab(colors[i].r, colors[i].g, colors[i].b)
+	}
+	cache := make([]atomic.Int32, 1<<(3*PALETTE_CACHE_BITS))
+	for i := range cache {
+		cache[i].Store(-1)
+	}
+	return &palette{colors: colors, cache: cache}
+}
+
+// Returns the palette entry that looks the most similar to the color
+func (p *palette) nearest(r, g, b uint8) paletteColor {
+	shift := 8 - PALETTE_CACHE_BITS
+	key := int(r>>shift)<<(2*PALETTE_CACHE_BITS) | int(g>>shift)<<PALETTE_CACHE_BITS | int(b>>shift)
+	if i := p.cache[key].Load(); i != -1 {
+		return p.colors[i]
+	}
+
+	// Every color in the bucket gets the nearest entry of the center of the bucket,
+	// so that the result doesn't depend on which color was looked up first
+	center := uint8(1 << (shift - 1))
+	lab := rgbToLab(r>>shift<<shift|center, g>>shift<<shift|center, b>>shift<<shift|center)
+	best, bestDistance := 0, math.Inf(1)
+	for i, c := range p.colors {
+		if d := lab.distance(c.lab); d < bestDistance {
+			best, bestDistance = i, d
+		}
+	}
+	p.cache[key].Store(int32(best))
+	return p.colors[best]
+}
+
+// The 16 ANSI colors, with the default values of xterm
+var palette16 = newPalette([]paletteColor{
+	{index: 0, r: 0, g: 0, b: 0},
+	{index: 1, r: 205, g: 0, b: 0},
+	{index: 2, r: 0, g: 205, b: 0},
+	{index: 3, r: 205, g: 205, b: 0},
+	{index: 4, r: 0, g: 0, b: 238},
+	{index: 5, r: 205, g: 0, b: 205},
+	{index: 6, r: 0, g: 205, b: 205},
+	{index: 7, r: 229, g: 229, b: 229},
+	{index: 8, r: 127, g: 127, b: 127},
+	{index: 9, r: 255, g: 0, b: 0},
+	{index: 10, r: 0, g: 255, b: 0},
+	{index: 11, r: 255, g: 255, b: 0},
+	{index: 12, r: 92, g: 92, b: 255},
+	{index: 13, r: 255, g: 0, b: 255},
+	{index: 14, r: 0, g: 255, b: 255},
+	{index: 15, r: 255, g: 255, b: 255},
+})
+
+// The xterm 256 color palette without the first 16 colors,
+// which are configurable and would make the result depend on the terminal theme
+var palette256 = newPalette(xterm256Colors())
+
+func xterm256Colors() []paletteColor {
+	colors := make([]paletteColor, 0, 240)
+
+	// 6x6x6 color cube
+	levels := []uint8{0, 95, 135, 175, 215, 255}
+	for r := 0; r < 6; r++ {
+		for g := 0; g < 6; g++ {
+			for b := 0; b < 6; b++ {
+				colors = append(colors, paletteColor{
+					index: 16 + r*36 + g*6 + b,
+					r:     levels[r], g: levels[g], b: levels[b],
+				})
+			}
+		}
+	}
+
+	// Grayscale ramp
+	for i := 0; i < 24; i++ {
+		v := uint8(8 + i*10)
+		colors = append(colors, paletteColor{index: 232 + i, r: v, g: v, b: v})
+	}
+
+	return colors
+}
+
+// Returns the escape sequence for a 16 color palette index
+func ansi16Col(bg bool, index int) string {
+	base := tern(bg, 40, 30)
+	if index >= 8 {
+		// Bright colors
+		base += 60
+		index -= 8
+	}
+	return fmt.Sprintf("\033[%dm", base+index)
+}
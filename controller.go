@@ -7,8 +7,11 @@ import (
 	"image"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
+	"github.com/asticode/go-astiav"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -19,13 +22,19 @@ const (
 	TIMER_BUFFER_SIZE       = 1
 )
 
-// Number of goroutines that will be started
-// and waited for
-const PCTX_RECEIVER_COUNT = 6
+// How far the arrow keys seek
+const (
+	SEEK_SHORT = 5 * time.Second
+	SEEK_LONG  = 60 * time.Second
+)
+
+// Maximum number of goroutines that will be started
+// and waited for, including the visualizer or the image viewer
+const PCTX_RECEIVER_COUNT = 8
 
 // ChannelContainer holds all communication channels for the pipeline
 type ChannelContainer struct {
-	VideoFrames     chan *image.Image
+	VideoFrames     chan *VideoFrame
 	AudioFrames     chan *AudioFrame
 	ConvertedFrames chan *Image
 	TimedFrames     chan *Image
@@ -42,6 +51,16 @@ type PlayerContext struct {
 	playerWG *PlayerFinishedWaitGroup
 	// central storage for all channels
 	channels ChannelContainer
+	// Statistics about the current playback
+	stats *PlaybackStats
+	// Subtitles of the current file
+	subtitles *SubtitleTrack
+	// Message shown on top of the video, kept between files
+	message *OverlayMessage
+	// The samples that were played last, for the visualizer
+	playedSamples *SampleHistory
+	// Text shown below the video for the whole file, like the title and artist of a song
+	caption string
 }
 
 // Reset resets the player context with a fresh context, error group, wait group,
@@ -49,8 +68,12 @@ type PlayerContext struct {
 func (p *PlayerContext) Reset() {
 	p.eg, p.ctx = errgroup.WithContext(context.Background())
 	p.playerWG.Reset()
+	p.stats.Reset()
+	p.subtitles = NewSubtitleTrack()
+	p.playedSamples = NewSampleHistory()
+	p.caption = ""
 	p.channels = ChannelContainer{
-		VideoFrames:     make(chan *image.Image, VIDEO_FRAME_BUFFER_SIZE),
+		VideoFrames:     make(chan *VideoFrame, VIDEO_FRAME_BUFFER_SIZE),
 		AudioFrames:     make(chan *AudioFrame, AUDIO_FRAME_BUFFER_SIZE),
 		ConvertedFrames: make(chan *Image, IMAGE_FRAME_BUFFER_SIZE),
 		TimedFrames:     make(chan *Image, TIMER_BUFFER_SIZE),
@@ -97,6 +120,103 @@ func catchSIGINT(pctx *PlayerContext) error {
 	}
 }
 
+// Handles key presses during playback
+func (c *Controller) handleInput() error {
+	for {
+		select {
+		case key := <-keyEvents:
+			if c.showsStillImage && key != KEY_QUIT {
+				// Any other key moves on to the next file
+				c.imageViewer.Stop()
+				continue
+			}
+			switch key {
+			case KEY_SPACE:
+				c.timer.TogglePause()
+			case KEY_LEFT:
+				c.loader.RequestSeek(c.timer.Position() - SEEK_SHORT)
+			case KEY_RIGHT:
+				c.loader.RequestSeek(c.timer.Position() + SEEK_SHORT)
+			case KEY_DOWN:
+				c.loader.RequestSeek(c.timer.Position() - SEEK_LONG)
+			case KEY_UP:
+				c.loader.RequestSeek(c.timer.Position() + SEEK_LONG)
+			case KEY_VOLUME_UP:
+				c.audioPlayer.volume.Change(VOLUME_STEP_DB)
+				c.pctx.message.Show(c.audioPlayer.volume.String())
+			case KEY_VOLUME_DOWN:
+				c.audioPlayer.volume.Change(-VOLUME_STEP_DB)
+				c.pctx.message.Show(c.audioPlayer.volume.String())
+			case KEY_MUTE:
+				c.audioPlayer.volume.ToggleMute()
+				c.pctx.message.Show(c.audioPlayer.volume.String())
+			case KEY_SPEED_UP:
+				speed := c.timer.ChangeSpeed(SPEED_STEP)
+				c.pctx.message.Show(fmt.Sprintf("Speed: %gx", speed))
+			case KEY_SPEED_DOWN:
+				speed := c.timer.ChangeSpeed(-SPEED_STEP)
+				c.pctx.message.Show(fmt.Sprintf("Speed: %gx", speed))
+			case KEY_AUDIO_DELAY_UP:
+				delay := c.audioPlayer.ChangeDelay(AUDIO_DELAY_STEP)
+				c.pctx.message.Show(fmt.Sprintf("Audio delay: %+d ms", delay.Milliseconds()))
+			case KEY_AUDIO_DELAY_DOWN:
+				delay := c.audioPlayer.ChangeDelay(-AUDIO_DELAY_STEP)
+				c.pctx.message.Show(fmt.Sprintf("Audio delay: %+d ms", delay.Milliseconds()))
+			case KEY_AUDIO_TRACK:
+				c.loader.RequestAudioStreamSwitch()
+			case KEY_QUIT:
+				logger.Info("controller", "Caught quit key")
+				return errors.New("user quit")
+			}
+		case <-c.pctx.ctx.Done():
+			// Player context cancelled, stop handling input
+			return nil
+		case <-c.pctx.playerWG.Done():
+			// Both audio and video players have finished playing
+			return nil
+		}
+	}
+}
+
+// Passes a still image decoded by the loader to the component that shows it
+func (c *Controller) showStillImage(img image.Image) {
+	if c.loader.HasCoverArt() {
+		c.visualizer.SetCoverArt(img)
+	} else {
+		c.imageViewer.SetImage(img)
+	}
+}
+
+// Discards all values that are currently buffered in `ch`
+func drain[T any](ch chan T) {
+	for {
+		select {
+		case _, ok := <-ch:
+			if !ok {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+// Discards all frames queued in the pipeline and moves the clocks to `pos`.
+// Called by the loader after seeking.
+// @returns the new seek generation, see `Timer.Generation`
+func (c *Controller) flushPipeline(pos time.Duration) uint64 {
+	// Drain in pipeline order, so that frames that are moved
+	// to the next stage while draining are discarded as well
+	drain(c.pctx.channels.VideoFrames)
+	drain(c.pctx.channels.AudioFrames)
+	drain(c.pctx.channels.ConvertedFrames)
+	drain(c.pctx.channels.TimedFrames)
+
+	generation := c.timer.Seek(pos)
+	c.audioPlayer.Seek(pos)
+	return generation
+}
+
 type Controller struct {
 	loader *MediaLoader
 
@@ -107,6 +227,13 @@ type Controller struct {
 	audioPlayer *AudioPlayer
 	videoPlayer *VideoPlayer
 
+	// Replaces the video of files that only have audio
+	visualizer *Visualizer
+	// Shows files that are a still image
+	imageViewer *ImageViewer
+	// Whether the current file is a still image, which is shown until a key is pressed
+	showsStillImage bool
+
 	// A context shared by all pipeline components
 	pctx *PlayerContext
 }
@@ -115,10 +242,12 @@ type Controller struct {
 func (c *Controller) reset() {
 	c.pctx.Reset()
 	c.loader.Reset(c.pctx.channels.VideoFrames, c.pctx.channels.AudioFrames)
-	c.videoConverter.Reset(c.pctx.channels.VideoFrames, c.pctx.channels.ConvertedFrames)
+	c.videoConverter.Reset(c.pctx.channels.VideoFrames, c.pctx.channels.ConvertedFrames, c.timer)
 	c.timer.Reset(c.pctx.channels.ConvertedFrames, c.pctx.channels.TimedFrames)
 	c.audioPlayer.Reset(c.pctx.channels.AudioFrames, c.timer)
 	c.videoPlayer.Reset(c.pctx.channels.TimedFrames)
+	c.visualizer.Reset(c.pctx.channels.VideoFrames, c.timer)
+	c.imageViewer.Reset(c.pctx.channels.VideoFrames, c.timer)
 	c.pctx.playerWG.Reset()
 }
 
@@ -126,9 +255,13 @@ func NewController() *Controller {
 	eg, ctx := errgroup.WithContext(context.Background())
 
 	pctx := &PlayerContext{
-		ctx:      ctx,
-		eg:       eg,
-		playerWG: NewPlayerFinishedWaitGroup(),
+		ctx:           ctx,
+		eg:            eg,
+		playerWG:      NewPlayerFinishedWaitGroup(),
+		stats:         NewPlaybackStats(),
+		subtitles:     NewSubtitleTrack(),
+		message:       NewOverlayMessage(),
+		playedSamples: NewSampleHistory(),
 	}
 
 	loader := NewMediaLoader(pctx)
@@ -136,6 +269,8 @@ func NewController() *Controller {
 	timer := NewTimer(pctx)
 	audioPlayer := NewAudioPlayer(pctx)
 	videoPlayer := NewVideoPlayer(pctx)
+	visualizer := NewVisualizer(pctx)
+	imageViewer := NewImageViewer(pctx)
 
 	controller := &Controller{
 		loader:         loader,
@@ -143,9 +278,14 @@ func NewController() *Controller {
 		timer:          timer,
 		audioPlayer:    audioPlayer,
 		videoPlayer:    videoPlayer,
+		visualizer:     visualizer,
+		imageViewer:    imageViewer,
 		pctx:           pctx,
 	}
 
+	loader.onSeek = controller.flushPipeline
+	loader.onStillImage = controller.showStillImage
+
 	// Initially setup controller
 	controller.reset()
 
@@ -156,22 +296,63 @@ func (c *Controller) Play(filename string) error {
 	// Prepare for new video playback by resetting channels and context.
 	c.reset()
 	c.pctx.playerWG.Reset()
+	// Keys pressed during the previous file belong to it
+	drain(keyEvents)
+
+	// Subtitles from a file replace the embedded ones
+	subtitleSelector := tern(userSubtitles == SUBTITLES_AUTO, "", userSubtitles)
+	subtitleFile := tern(userSubtitles == SUBTITLES_OFF, "", userSubtitleFile)
+	if subtitleFile == "" && userSubtitles == SUBTITLES_AUTO {
+		subtitleFile = findSubtitleFile(filename)
+	}
+	if subtitleFile != "" {
+		if err := c.pctx.subtitles.LoadFile(subtitleFile); err != nil {
+			return err
+		}
+		subtitleSelector = SUBTITLES_OFF
+	}
 
+	c.loader.SelectStreams(userVideoStream, userAudioStream, subtitleSelector)
+	c.loader.SetOutputSampleRate(int(userSampleRate))
 	err := c.loader.OpenFile(filename)
 	if err != nil {
 		return err
 	}
-	fps, sampleRate := c.loader.GetInfo()
+	sampleRate := c.loader.GetInfo()
+	if c.loader.HasCoverArt() {
+		c.pctx.caption = strings.TrimSpace(c.loader.Metadata("title") + "\n" + c.loader.Metadata("artist"))
+	}
+	if userFPS != 0 {
+		c.loader.SetOutputFPS(astiav.NewRational(int(userFPS), 1))
+	}
+
+	// Read single key presses for the duration of the playback
+	if err := enterRawMode(); err != nil {
+		logger.Error("controller", "Could not enter raw mode, keyboard input disabled: %v", err)
+	} else {
+		defer exitRawMode()
+		startInputReader()
+	}
 
 	// Start all components
 	c.pctx.eg.Go(c.loader.Start)
 	c.pctx.eg.Go(c.videoConverter.Start)
-	c.pctx.eg.Go(func() error { return c.timer.Start(fps) })
+	c.pctx.eg.Go(c.timer.Start)
 	c.pctx.eg.Go(func() error { return c.audioPlayer.Start(sampleRate) })
 	c.pctx.eg.Go(c.videoPlayer.Start)
+	c.showsStillImage = c.loader.IsStillImage()
+	if c.showsStillImage {
+		logger.Info("controller", "File is a still image, showing it until a key is pressed")
+		c.pctx.eg.Go(c.imageViewer.Start)
+	} else if !c.loader.HasVideo() {
+		logger.Info("controller", "No video stream, showing the visualizer")
+		c.pctx.eg.Go(func() error { return c.visualizer.Start(sampleRate) })
+	}
 	c.pctx.eg.Go(func() error { return catchSIGINT(c.pctx) })
+	c.pctx.eg.Go(c.handleInput)
 
 	// Wait for all components to finish normally or with an error
 	err = c.pctx.eg.Wait()
+	c.pctx.stats.Log()
 	return err
 }
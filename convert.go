@@ -1,7 +1,6 @@
 package main
 
 import (
-	"fmt"
 	"image"
 	"math"
 	"time"
@@ -10,15 +9,25 @@ import (
 )
 
 type VideoConverter struct {
-	input  chan *image.Image
+	input  chan *VideoFrame
 	output chan *Image
 	pctx   *PlayerContext
+	// Used to drop frames that are too late before converting them
+	timer *Timer
+	// The last converted image and its result.
+	// Frames can be repeated to match the target fps,
+	// in which case the previous result is reused.
+	lastInput  image.Image
+	lastOutput *Image
 }
 
-// Reset sets up the input and output channels using parameters.
-func (v *VideoConverter) Reset(input chan *image.Image, output chan *Image) {
+// Reset sets up the input and output channels and timer reference using parameters.
+func (v *VideoConverter) Reset(input chan *VideoFrame, output chan *Image, timer *Timer) {
 	v.input = input
 	v.output = output
+	v.timer = timer
+	v.lastInput = nil
+	v.lastOutput = nil
 }
 
 func NewVideoConverter(pctx *PlayerContext) *VideoConverter {
@@ -35,19 +44,40 @@ func (v *VideoConverter) Start() error {
 			// Error occurred
 			logger.Info("videoConverter", "Stopped")
 			return nil
-		case img, ok := <-v.input:
+		case frame, ok := <-v.input:
 			if !ok {
 				close(v.output)
 				logger.Info("videoConverter", "No more frames to convert")
 				return nil
 			}
+			if v.timer.IsStale(frame.generation) {
+				// The frame belongs to the position before a seek
+				continue
+			}
+			if v.timer.ShouldDrop(frame.pts) {
+				// Don't waste time converting a frame that won't be shown
+				continue
+			}
+
 			start := time.Now()
 
-			ascii, err := convertImage(img)
+			needsClear, err := updateTermSize()
 			if err != nil {
 				return err
 			}
-			logger.Info("videoConverter", "Frame took %v to convert", time.Since(start))
+
+			var ascii *Image
+			if frame.img == v.lastInput && !needsClear {
+				// Repeated frame, the size didn't change either
+				ascii = &Image{frame: v.lastOutput.frame, raw: v.lastOutput.raw}
+				logger.Debug("videoConverter", "Reused repeated frame")
+			} else {
+				ascii = convertImage(frame.img, needsClear)
+				logger.Info("videoConverter", "Frame took %v to convert", time.Since(start))
+			}
+			ascii.pts = frame.pts
+			ascii.generation = frame.generation
+			v.lastInput, v.lastOutput = frame.img, ascii
 
 			select {
 			case <-v.pctx.ctx.Done():
@@ -72,102 +102,232 @@ func toBrightness(r, g, b uint32, a float64) float64 {
 	return float64(r+g+b) / 3 * a
 }
 
-func ANSICol(bg bool, r, g, b int) string {
-	if bg {
-		return fmt.Sprintf("\033[48;2;%03v;%03v;%03vm", r, g, b)
-	} else {
-		return fmt.Sprintf("\033[38;2;%03v;%03v;%03vm", r, g, b)
+// Measures the terminal size again if needed
+// @returns whether the screen needs to be cleared because the size changed
+func updateTermSize() (needsClear bool, err error) {
+	if !termData.defined || allowResize {
+		return termData.updateSize()
 	}
+	return false, nil
 }
 
-func convertImage(img *image.Image) (*Image, error) {
-	needsClear := false
-	if !termData.defined || allowResize {
-		var err error
-		needsClear, err = termData.updateSize()
-		if err != nil {
-			return nil, err
+// Describes how the pixels of the resized image map to characters
+type cellLayout struct {
+	cellsPerPixel  uint // How many characters wide a pixel is
+	pixelsPerCellX uint // How many pixels fit into a character horizontally
+	pixelsPerCellY uint // How many pixels fit into a character vertically
+}
+
+// Returns the layout used by the current render mode
+func currentCellLayout() cellLayout {
+	switch renderMode {
+	case RENDER_HALF_BLOCK:
+		// A character is roughly `ratio` times as high as wide,
+		// so a half block is about `ratio/2` times as high as wide
+		return cellLayout{
+			cellsPerPixel:  max(1, uint(math.Round(float64(termData.ratio)/2))),
+			pixelsPerCellX: 1,
+			pixelsPerCellY: 2,
 		}
+	case RENDER_BRAILLE:
+		// A braille character has 2x4 dots
+		return cellLayout{cellsPerPixel: 1, pixelsPerCellX: 2, pixelsPerCellY: 4}
+	default:
+		return cellLayout{cellsPerPixel: termData.ratio, pixelsPerCellX: 1, pixelsPerCellY: 1}
 	}
+}
 
+// Returns how many times higher than wide a pixel is shown
+func (c cellLayout) pixelAspect() float64 {
+	return float64(termData.ratio*c.pixelsPerCellX) / float64(c.pixelsPerCellY*c.cellsPerPixel)
+}
+
+// Resizes the image to fit into the terminal and the size specified by the user
+func resizeToFit(img image.Image, layout cellLayout) image.Image {
 	// limit size to terminal size and user input
-	maxWidth := min(tern(userWidth == 0, termData.cols, userWidth)/termData.ratio, termData.cols/termData.ratio)
-	maxHeight := min(tern(userHeight == 0, termData.rows, userHeight), termData.rows)
+	maxWidth := min(tern(userWidth == 0, termData.cols, userWidth), termData.cols) / layout.cellsPerPixel * layout.pixelsPerCellX
+	maxHeight := min(tern(userHeight == 0, termData.rows, userHeight), termData.rows) * layout.pixelsPerCellY
+
+	aspect := layout.pixelAspect()
+	if aspect == 1 {
+		return resize.Thumbnail(maxWidth, maxHeight, img, resize.NearestNeighbor)
+	}
+
+	// Pixels aren't square, so the image has to be stretched
+	// to keep its aspect ratio on screen
+	width := float64(img.Bounds().Dx())
+	height := float64(img.Bounds().Dy()) / aspect
+	scale := min(1, float64(maxWidth)/width, float64(maxHeight)/height)
+	return resize.Resize(max(1, uint(width*scale)), max(1, uint(height*scale)), img, resize.NearestNeighbor)
+}
 
-	resizedImg := resize.Thumbnail(maxWidth, maxHeight, *img, resize.NearestNeighbor)
+// Resizes the image to fit into the terminal in pixels, for graphics output.
+// Unlike characters, images are also scaled up to fill the terminal.
+func resizeToPixels(img image.Image) image.Image {
+	cellWidth, cellHeight := termData.cellSize()
+	cols := min(tern(userWidth == 0, termData.cols, userWidth), termData.cols)
+	// Leave the last row empty, so the terminal doesn't scroll
+	rows := min(tern(userHeight == 0, termData.rows-1, userHeight), termData.rows-1)
 
-	var asciiData []rune
+	maxWidth := float64(cols) * cellWidth
+	maxHeight := float64(rows) * cellHeight
+	width, height := float64(img.Bounds().Dx()), float64(img.Bounds().Dy())
+	scale := min(maxWidth/width, maxHeight/height)
+	return resize.Resize(max(1, uint(width*scale)), max(1, uint(height*scale)), img, resize.NearestNeighbor)
+}
 
-	if colorEnabled {
-		asciiData = imgToASCIIColor(&resizedImg)
-	} else {
-		asciiData = imgToASCII(&resizedImg)
+func convertImage(img image.Image, needsClear bool) *Image {
+	switch outputMode {
+	case OUTPUT_SIXEL:
+		return &Image{
+			raw:        imgToSixel(ditherImage(resizeToPixels(img))),
+			needsClear: needsClear,
+		}
+	case OUTPUT_KITTY:
+		return &Image{
+			raw:        imgToKitty(resizeToPixels(img)),
+			needsClear: needsClear,
+		}
+	case OUTPUT_ITERM:
+		return &Image{
+			raw:        imgToITerm(resizeToPixels(img)),
+			needsClear: needsClear,
+		}
+	}
+
+	layout := currentCellLayout()
+	resizedImg := ditherImage(resizeToFit(img, layout))
+
+	var frame *Frame
+
+	switch {
+	case renderMode == RENDER_HALF_BLOCK:
+		frame = imgToHalfBlock(&resizedImg, layout)
+	case renderMode == RENDER_BRAILLE:
+		frame = imgToBraille(&resizedImg)
+	case colorEnabled:
+		frame = imgToASCIIColor(&resizedImg)
+	default:
+		frame = imgToASCII(&resizedImg)
 	}
 
 	return &Image{
-		data:       asciiData,
+		frame:      frame,
 		needsClear: needsClear,
-	}, nil
+	}
 }
 
-func imgToASCII(img *image.Image) []rune {
+func imgToASCII(img *image.Image) *Frame {
 	imgWidth, imgHeight := (*img).Bounds().Dx(), (*img).Bounds().Dy()
+	frame := NewFrame(imgWidth*int(termData.ratio), imgHeight)
 
-	asciiData := make([]rune, imgWidth*imgHeight*int(termData.ratio)+imgHeight) // + imgHeight for newlines
-
-	dataWidth := imgWidth*int(termData.ratio) + 1
 	for y := 0; y < imgHeight; y++ {
 		for x := 0; x < imgWidth; x++ {
 			r, g, b, a_uint := (*img).At(x, y).RGBA()
 			r, g, b, a := normalizeRGBA(r, g, b, a_uint)
 			brightness := toBrightness(r, g, b, a)
 			chr := toASCII(brightness)
-			index := y*dataWidth + x*int(termData.ratio)
 			for i := 0; i < int(termData.ratio); i++ {
-				asciiData[index+i] = chr
+				frame.At(x*int(termData.ratio)+i, y).glyph = chr
 			}
 		}
-		asciiData[(y+1)*dataWidth-1] = '\n'
 	}
-	return asciiData
+	return frame
 }
 
-const ANSI_COLOR_LENGTH = 19
-const ANSI_RESET = "\033[0m"
-
-func imgToASCIIColor(img *image.Image) []rune {
+func imgToASCIIColor(img *image.Image) *Frame {
 	imgWidth, imgHeight := (*img).Bounds().Dx(), (*img).Bounds().Dy()
+	frame := NewFrame(imgWidth*int(termData.ratio), imgHeight)
 
-	totalSize := imgHeight * (imgWidth*(len(ANSI_RESET)+ANSI_COLOR_LENGTH+int(termData.ratio)) + 1)
-
-	asciiData := make([]rune, totalSize)
-
-	index := 0
-	prevColor := ""
 	for y := 0; y < imgHeight; y++ {
 		for x := 0; x < imgWidth; x++ {
 			r, g, b, a_uint := (*img).At(x, y).RGBA()
 			r, g, b, a := normalizeRGBA(r, g, b, a_uint)
 			brightness := toBrightness(r, g, b, a)
 			chr := toASCII(brightness)
+			for i := 0; i < int(termData.ratio); i++ {
+				*frame.At(x*int(termData.ratio)+i, y) = Cell{glyph: chr, fg: RGB(r, g, b)}
+			}
+		}
+	}
+	return frame
+}
+
+// Converts the image to colored half blocks.
+// Every character shows two pixels above each other,
+// the upper one as the foreground and the lower one as the background color.
+func imgToHalfBlock(img *image.Image, layout cellLayout) *Frame {
+	imgWidth, imgHeight := (*img).Bounds().Dx(), (*img).Bounds().Dy()
+	frame := NewFrame(imgWidth*int(layout.cellsPerPixel), (imgHeight+1)/2)
 
-			color := ANSICol(false, int(r), int(g), int(b))
-			if color != prevColor {
-				copy(asciiData[index:], []rune(ANSI_RESET))
-				index += len(ANSI_RESET)
+	for y := 0; y < imgHeight; y += 2 {
+		for x := 0; x < imgWidth; x++ {
+			r, g, b, _ := normalizeRGBA((*img).At(x, y).RGBA())
+			cell := Cell{glyph: '▀', fg: RGB(r, g, b)}
 
-				copy(asciiData[index:], []rune(color))
-				index += ANSI_COLOR_LENGTH
-				prevColor = color
+			// The last row has no lower pixel if the height is odd
+			if y+1 < imgHeight {
+				r, g, b, _ := normalizeRGBA((*img).At(x, y+1).RGBA())
+				cell.bg = RGB(r, g, b)
 			}
 
-			for i := 0; i < int(termData.ratio); i++ {
-				asciiData[index+i] = chr
+			for i := 0; i < int(layout.cellsPerPixel); i++ {
+				*frame.At(x*int(layout.cellsPerPixel)+i, y/2) = cell
+			}
+		}
+	}
+	return frame
+}
+
+// The first braille character, which has no dots
+const BRAILLE_BASE = 0x2800
+
+// Bits of the braille dots, indexed by [y][x] inside the character
+var BRAILLE_DOTS = [4][2]rune{
+	{0x01, 0x08},
+	{0x02, 0x10},
+	{0x04, 0x20},
+	{0x40, 0x80},
+}
+
+// Brightness above which a braille dot is set
+const BRAILLE_THRESHOLD = 255 / 2
+
+// Converts the image to braille characters with 2x4 dots each.
+// If color is enabled, each character gets the average color of its set dots.
+func imgToBraille(img *image.Image) *Frame {
+	imgWidth, imgHeight := (*img).Bounds().Dx(), (*img).Bounds().Dy()
+
+	cols := (imgWidth + 1) / 2
+	rows := (imgHeight + 3) / 4
+	frame := NewFrame(cols, rows)
+
+	for row := 0; row < rows; row++ {
+		for col := 0; col < cols; col++ {
+			chr := rune(BRAILLE_BASE)
+			var rSum, gSum, bSum, count uint32
+			for dy := 0; dy < 4; dy++ {
+				for dx := 0; dx < 2; dx++ {
+					x, y := col*2+dx, row*4+dy
+					if x >= imgWidth || y >= imgHeight {
+						continue
+					}
+					r, g, b, a := normalizeRGBA((*img).At(x, y).RGBA())
+					if toBrightness(r, g, b, a) <= BRAILLE_THRESHOLD {
+						continue
+					}
+					chr |= BRAILLE_DOTS[dy][dx]
+					rSum, gSum, bSum = rSum+r, gSum+g, bSum+b
+					count++
+				}
+			}
+
+			cell := frame.At(col, row)
+			cell.glyph = chr
+			if colorEnabled && count > 0 {
+				cell.fg = RGB(rSum/count, gSum/count, bSum/count)
 			}
-			index += int(termData.ratio)
 		}
-		asciiData[index] = '\n'
-		index++
 	}
-	return asciiData
+	return frame
 }
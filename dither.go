@@ -0,0 +1,217 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// How the image is dithered before it is quantized
+type DitherMode int
+
+const (
+	DITHER_NONE            DitherMode = iota // No dithering
+	DITHER_ORDERED                           // Ordered dithering with a Bayer matrix
+	DITHER_FLOYD_STEINBERG                   // Floyd-Steinberg error diffusion
+	DITHER_ATKINSON                          // Atkinson error diffusion
+)
+
+var ditherMode DitherMode
+
+// 8x8 Bayer matrix for ordered dithering.
+// Ordered dithering only depends on the position of a pixel,
+// so the pattern stays in place between frames instead of crawling.
+var BAYER_MATRIX = [8][8]float64{
+	{0, 32, 8, 40, 2, 34, 10, 42},
+	{48, 16, 56, 24, 50, 18, 58, 26},
+	{12, 44, 4, 36, 14, 46, 6, 38},
+	{60, 28, 52, 20, 62, 30, 54, 22},
+	{3, 35, 11, 43, 1, 33, 9, 41},
+	{51, 19, 59, 27, 49, 17, 57, 25},
+	{15, 47, 7, 39, 13, 45, 5, 37},
+	{63, 31, 55, 23, 61, 29, 53, 21},
+}
+
+// A part of an error diffusion kernel
+type diffusion struct {
+	dx, dy int
+	weight float64
+}
+
+var FLOYD_STEINBERG_KERNEL = []diffusion{
+	{1, 0, 7.0 / 16},
+	{-1, 1, 3.0 / 16},
+	{0, 1, 5.0 / 16},
+	{1, 1, 1.0 / 16},
+}
+
+// Atkinson only diffuses 3/4 of the error, which keeps more contrast
+var ATKINSON_KERNEL = []diffusion{
+	{1, 0, 1.0 / 8},
+	{2, 0, 1.0 / 8},
+	{-1, 1, 1.0 / 8},
+	{0, 1, 1.0 / 8},
+	{1, 1, 1.0 / 8},
+	{0, 2, 1.0 / 8},
+}
+
+// Maps colors to the nearest color that can be shown
+type quantizer interface {
+	quantize(r, g, b float64) (float64, float64, float64)
+	// Distance between neighbouring colors, used to scale ordered dithering
+	step() float64
+}
+
+// Quantizes the brightness to a number of evenly spaced levels,
+// such as the characters of a character set.
+// The hue is kept by shifting all channels equally.
+type brightnessQuantizer struct {
+	levels int
+}
+
+func (q brightnessQuantizer) quantize(r, g, b float64) (float64, float64, float64) {
+	brightness := (r + g + b) / 3
+	level := math.Round(clamp(brightness, 0, 255) / q.step())
+	shift := level*q.step() - brightness
+	return r + shift, g + shift, b + shift
+}
+
+func (q brightnessQuantizer) step() float64 {
+	return 255 / float64(max(q.levels-1, 1))
+}
+
+// Quantizes every channel to a number of evenly spaced levels
+type channelQuantizer struct {
+	levels int
+}
+
+func (q channelQuantizer) quantize(r, g, b float64) (float64, float64, float64) {
+	level := func(v float64) float64 {
+		return math.Round(clamp(v, 0, 255)/q.step()) * q.step()
+	}
+	return level(r), level(g), level(b)
+}
+
+func (q channelQuantizer) step() float64 {
+	return 255 / float64(max(q.levels-1, 1))
+}
+
+// Quantizes colors to the nearest color of a palette
+type paletteQuantizer struct {
+	palette     *palette
+	paletteStep float64
+}
+
+func (q paletteQuantizer) quantize(r, g, b float64) (float64, float64, float64) {
+	c := q.palette.nearest(clampUint8(r), clampUint8(g), clampUint8(b))
+	return float64(c.r), float64(c.g), float64(c.b)
+}
+
+func (q paletteQuantizer) step() float64 {
+	return q.paletteStep
+}
+
+func clamp(v, low, high float64) float64 {
+	return max(low, min(v, high))
+}
+
+func clampUint8(v float64) uint8 {
+	return uint8(math.Round(clamp(v, 0, 255)))
+}
+
+// Returns the quantizer matching how the current output mode shows colors,
+// or nil if the colors are shown as they are
+func currentQuantizer() quantizer {
+	switch {
+	case outputMode == OUTPUT_SIXEL:
+		return channelQuantizer{levels: SIXEL_CUBE_LEVELS}
+	case outputMode != OUTPUT_TEXT:
+		return nil
+	case renderMode == RENDER_BRAILLE:
+		// Dots are either set or not
+		return brightnessQuantizer{levels: 2}
+	case (renderMode == RENDER_HALF_BLOCK || colorEnabled) && colorDepth == COLOR_DEPTH_256:
+		return paletteQuantizer{palette: palette256, paletteStep: 255 / 5}
+	case (renderMode == RENDER_HALF_BLOCK || colorEnabled) && colorDepth == COLOR_DEPTH_16:
+		return paletteQuantizer{palette: palette16, paletteStep: 255}
+	case renderMode == RENDER_HALF_BLOCK || len(CHARS) < 2:
+		return nil
+	default:
+		return brightnessQuantizer{levels: len(CHARS)}
+	}
+}
+
+// Dithers the image with the current dither mode,
+// so that quantizing it afterwards doesn't produce bands.
+// The colors are already multiplied by alpha, like drawn on black, so the result is opaque.
+// Otherwise alpha would be applied again and move the colors off the quantized levels.
+func ditherImage(img image.Image) image.Image {
+	q := currentQuantizer()
+	if ditherMode == DITHER_NONE || q == nil {
+		return img
+	}
+
+	switch ditherMode {
+	case DITHER_ORDERED:
+		return ditherOrdered(img, q)
+	case DITHER_FLOYD_STEINBERG:
+		return ditherErrorDiffusion(img, q, FLOYD_STEINBERG_KERNEL)
+	case DITHER_ATKINSON:
+		return ditherErrorDiffusion(img, q, ATKINSON_KERNEL)
+	default:
+		return img
+	}
+}
+
+func ditherOrdered(img image.Image, q quantizer) image.Image {
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	dithered := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			r, g, b, _ := normalizeRGBA(img.At(x, y).RGBA())
+
+			// Shift the color by up to half a step in either direction
+			offset := ((BAYER_MATRIX[y%8][x%8]+0.5)/64 - 0.5) * q.step()
+			qr, qg, qb := q.quantize(float64(r)+offset, float64(g)+offset, float64(b)+offset)
+			dithered.Set(x, y, color.RGBA{clampUint8(qr), clampUint8(qg), clampUint8(qb), 255})
+		}
+	}
+	return dithered
+}
+
+func ditherErrorDiffusion(img image.Image, q quantizer, kernel []diffusion) image.Image {
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	dithered := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	// The image with the error of already quantized pixels added
+	pixels := make([][3]float64, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			r, g, b, _ := normalizeRGBA(img.At(x, y).RGBA())
+			pixels[y*width+x] = [3]float64{float64(r), float64(g), float64(b)}
+		}
+	}
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			p := pixels[y*width+x]
+			qr, qg, qb := q.quantize(p[0], p[1], p[2])
+			dithered.Set(x, y, color.RGBA{clampUint8(qr), clampUint8(qg), clampUint8(qb), 255})
+
+			// Spread the error to the neighbouring pixels that aren't quantized yet
+			errR, errG, errB := p[0]-qr, p[1]-qg, p[2]-qb
+			for _, d := range kernel {
+				nx, ny := x+d.dx, y+d.dy
+				if nx < 0 || nx >= width || ny >= height {
+					continue
+				}
+				n := &pixels[ny*width+nx]
+				n[0] += errR * d.weight
+				n[1] += errG * d.weight
+				n[2] += errB * d.weight
+			}
+		}
+	}
+	return dithered
+}
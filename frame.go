@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const ANSI_RESET = "\033[0m"
+
+// If more than this share of the cells changed, the whole frame is redrawn,
+// as moving the cursor around would take more bytes than it saves
+const DIFF_FULL_REDRAW_RATIO = 0.5
+
+// Unchanged cells between two changed ones are redrawn if there are at most this many,
+// which is shorter than the escape sequence to move the cursor over them
+const DIFF_MAX_GAP = 4
+
+// A color of a cell. The zero value is the default color of the terminal.
+type CellColor struct {
+	r, g, b uint8
+	isSet   bool
+}
+
+func RGB(r, g, b uint32) CellColor {
+	return CellColor{r: uint8(r), g: uint8(g), b: uint8(b), isSet: true}
+}
+
+// Text attributes of a cell
+type CellAttrs uint8
+
+const (
+	ATTR_BOLD CellAttrs = 1 << iota
+	ATTR_REVERSE
+)
+
+// One character cell of the terminal
+type Cell struct {
+	glyph  rune
+	fg, bg CellColor
+	attrs  CellAttrs
+}
+
+// Whether both cells are drawn with the same colors and attributes
+func (c Cell) sameStyle(o Cell) bool {
+	return c.fg == o.fg && c.bg == o.bg && c.attrs == o.attrs
+}
+
+// A frame as a grid of cells,
+// independent of the escape sequences that are used to draw it
+type Frame struct {
+	width, height int
+	// The cells row by row
+	cells []Cell
+}
+
+// Creates a frame filled with spaces in the default colors
+func NewFrame(width, height int) *Frame {
+	cells := make([]Cell, width*height)
+	for i := range cells {
+		cells[i].glyph = ' '
+	}
+	return &Frame{width: width, height: height, cells: cells}
+}
+
+func (f *Frame) At(x, y int) *Cell {
+	return &f.cells[y*f.width+x]
+}
+
+func (f *Frame) Row(y int) []Cell {
+	return f.cells[y*f.width : (y+1)*f.width]
+}
+
+func (f *Frame) Clone() *Frame {
+	return &Frame{width: f.width, height: f.height, cells: append([]Cell(nil), f.cells...)}
+}
+
+func (f *Frame) sameSize(o *Frame) bool {
+	return f.width == o.width && f.height == o.height
+}
+
+// Returns the escape sequence for a foreground or background color.
+// The color is mapped to the nearest palette color if the terminal doesn't support truecolor.
+func ANSICol(bg bool, r, g, b int) string {
+	switch colorDepth {
+	case COLOR_DEPTH_256:
+		c := palette256.nearest(uint8(r), uint8(g), uint8(b))
+		return fmt.Sprintf("\033[%d;5;%dm", tern(bg, 48, 38), c.index)
+	case COLOR_DEPTH_16:
+		c := palette16.nearest(uint8(r), uint8(g), uint8(b))
+		return ansi16Col(bg, c.index)
+	}
+
+	if bg {
+		return fmt.Sprintf("\033[48;2;%03v;%03v;%03vm", r, g, b)
+	} else {
+		return fmt.Sprintf("\033[38;2;%03v;%03v;%03vm", r, g, b)
+	}
+}
+
+// Returns the escape sequences that set the colors and attributes of a cell,
+// starting from the default style
+func cellStyle(c Cell) string {
+	style := ANSI_RESET
+	if c.attrs&ATTR_BOLD != 0 {
+		style += "\033[1m"
+	}
+	if c.attrs&ATTR_REVERSE != 0 {
+		style += "\033[7m"
+	}
+	if c.fg.isSet {
+		style += ANSICol(false, int(c.fg.r), int(c.fg.g), int(c.fg.b))
+	}
+	if c.bg.isSet {
+		style += ANSICol(true, int(c.bg.r), int(c.bg.g), int(c.bg.b))
+	}
+	return style
+}
+
+// Writes cells at the current cursor position.
+// The terminal has to use the default style before,
+// and uses it again afterwards.
+func writeCells(sb *strings.Builder, cells []Cell) {
+	var current Cell
+	for _, c := range cells {
+		if !c.sameStyle(current) {
+			if c.sameStyle(Cell{}) {
+				sb.WriteString(ANSI_RESET)
+			} else {
+				sb.WriteString(cellStyle(c))
+			}
+			current = c
+		}
+		sb.WriteRune(c.glyph)
+	}
+	if !current.sameStyle(Cell{}) {
+		// Reset so that the background doesn't bleed into the next line
+		sb.WriteString(ANSI_RESET)
+	}
+}
+
+// Serialize returns the escape sequences and characters that draw the whole frame,
+// starting at the current cursor position.
+// There is no newline after the last row, so that a frame
+// as high as the terminal doesn't scroll it.
+func (f *Frame) Serialize() string {
+	var sb strings.Builder
+	sb.Grow(f.width * f.height)
+	for y := 0; y < f.height; y++ {
+		if y > 0 {
+			sb.WriteString(string(NEWLINE_TERM))
+		}
+		writeCells(&sb, f.Row(y))
+	}
+	return sb.String()
+}
+
+// Counts the cells that differ from `prev`, which has to be the same size
+func (f *Frame) changedCells(prev *Frame) int {
+	changed := 0
+	for i, c := range f.cells {
+		if prev.cells[i] != c {
+			changed++
+		}
+	}
+	return changed
+}
+
+// SerializeDiff returns the escape sequences and characters that turn `prev` into this frame,
+// which have to be the same size.
+// Only the changed cells are written, after moving the cursor to them.
+func (f *Frame) SerializeDiff(prev *Frame) string {
+	var sb strings.Builder
+
+	for y := 0; y < f.height; y++ {
+		row, prevRow := f.Row(y), prev.Row(y)
+		for x := 0; x < f.width; x++ {
+			if prevRow[x] == row[x] {
+				continue
+			}
+
+			// Extend the run of changed cells, including short unchanged gaps
+			end := x + 1
+			for gap := 0; end < f.width && gap <= DIFF_MAX_GAP; end++ {
+				if prevRow[end] == row[end] {
+					gap++
+				} else {
+					gap = 0
+				}
+			}
+			for end > x && prevRow[end-1] == row[end-1] {
+				end--
+			}
+
+			// Cursor positions start at 1
+			sb.WriteString("\033[" + strconv.Itoa(y+1) + ";" + strconv.Itoa(x+1) + "H")
+			writeCells(&sb, row[x:end])
+			x = end - 1
+		}
+	}
+	return sb.String()
+}
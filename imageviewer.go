@@ -0,0 +1,107 @@
+package main
+
+import (
+	"image"
+	"sync"
+	"time"
+)
+
+// How often a still image is sent again, so that it is resized with the terminal
+const STILL_IMAGE_FPS = 4
+
+// ImageViewer shows a still image, like a photo, until a key is pressed or the time set with `-duration` elapsed.
+// Still images are decoded as videos with one frame, which would only be shown for an instant.
+type ImageViewer struct {
+	output chan *VideoFrame
+	// Provides the position the frames are shown at
+	timer *Timer
+	// The image to show, set by the loader once it is decoded
+	img   image.Image
+	imgMu sync.Mutex
+	// Receives requests to stop showing the image
+	stopRequests chan struct{}
+	pctx         *PlayerContext
+}
+
+// Reset sets up the output channel and timer reference
+func (v *ImageViewer) Reset(output chan *VideoFrame, timer *Timer) {
+	v.output = output
+	v.timer = timer
+	v.stopRequests = make(chan struct{}, 1)
+	v.imgMu.Lock()
+	v.img = nil
+	v.imgMu.Unlock()
+}
+
+func NewImageViewer(pctx *PlayerContext) *ImageViewer {
+	return &ImageViewer{
+		pctx: pctx,
+	}
+	// Output channel set in Reset
+}
+
+// Sets the image to show
+func (v *ImageViewer) SetImage(img image.Image) {
+	v.imgMu.Lock()
+	defer v.imgMu.Unlock()
+	v.img = img
+}
+
+// Returns the image to show, or nil if it wasn't decoded yet
+func (v *ImageViewer) currentImage() image.Image {
+	v.imgMu.Lock()
+	defer v.imgMu.Unlock()
+	return v.img
+}
+
+// Requests the viewer to stop showing the image, which ends the playback of the file
+func (v *ImageViewer) Stop() {
+	select {
+	case v.stopRequests <- struct{}{}:
+	default:
+		// A stop is already pending
+	}
+}
+
+// Sends the image `STILL_IMAGE_FPS` times per second until it is stopped
+func (v *ImageViewer) Start() error {
+	logger.Info("imageViewer", "Started")
+
+	ticker := time.NewTicker(time.Second / STILL_IMAGE_FPS)
+	defer ticker.Stop()
+
+	// Never fires if the image is shown until a key is pressed
+	var deadline <-chan time.Time
+	if userDuration > 0 {
+		deadline = time.After(userDuration)
+	}
+
+	for {
+		select {
+		case <-v.pctx.ctx.Done():
+			logger.Info("imageViewer", "Stopped")
+			return nil
+		case <-v.stopRequests:
+			close(v.output)
+			logger.Info("imageViewer", "Stopped by key press")
+			return nil
+		case <-deadline:
+			close(v.output)
+			logger.Info("imageViewer", "Showed image for %s", userDuration)
+			return nil
+		case <-ticker.C:
+			img := v.currentImage()
+			if img == nil || v.timer.IsPaused() {
+				continue
+			}
+
+			// The same image is sent every time, so the converter only converts it again when the size changed
+			select {
+			case <-v.pctx.ctx.Done():
+				logger.Info("imageViewer", "Stopped")
+				return nil
+			case v.output <- &VideoFrame{img: img, pts: v.timer.Position(), generation: v.timer.Generation()}:
+			}
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"os"
+	"sync"
+)
+
+// A key press read from the terminal
+type Key int
+
+const (
+	KEY_UNKNOWN Key = iota
+	KEY_SPACE
+	KEY_QUIT
+	KEY_LEFT
+	KEY_RIGHT
+	KEY_UP
+	KEY_DOWN
+	KEY_AUDIO_TRACK
+	KEY_VOLUME_UP
+	KEY_VOLUME_DOWN
+	KEY_MUTE
+	KEY_SPEED_UP
+	KEY_SPEED_DOWN
+	KEY_AUDIO_DELAY_UP
+	KEY_AUDIO_DELAY_DOWN
+)
+
+// Receives key presses from the terminal.
+// Key presses are only read while the terminal is in raw mode.
+var keyEvents = make(chan Key, 16)
+
+var startInputOnce sync.Once
+
+// Starts the goroutine that reads key presses from stdin.
+// Reading from stdin blocks and can't be cancelled,
+// so the goroutine lives for the entire lifetime of the program.
+func startInputReader() {
+	startInputOnce.Do(func() {
+		go readInput()
+	})
+}
+
+func readInput() {
+	buf := make([]byte, 64)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			logger.Error("input", "Failed to read from stdin: %v", err)
+			return
+		}
+
+		for _, key := range parseKeys(buf[:n]) {
+			select {
+			case keyEvents <- key:
+			default:
+				logger.Info("input", "Dropping key press, too many pending")
+			}
+		}
+	}
+}
+
+// Converts raw bytes read from the terminal to key presses
+func parseKeys(data []byte) []Key {
+	keys := make([]Key, 0, len(data))
+	for i := 0; i < len(data); i++ {
+		switch data[i] {
+		case ' ':
+			keys = append(keys, KEY_SPACE)
+		case 'q', 'Q', 0x03: // 0x03 is Ctrl-C, which doesn't raise SIGINT in raw mode
+			keys = append(keys, KEY_QUIT)
+		case 'a', 'A':
+			keys = append(keys, KEY_AUDIO_TRACK)
+		case '0':
+			keys = append(keys, KEY_VOLUME_UP)
+		case '9':
+			keys = append(keys, KEY_VOLUME_DOWN)
+		case 'm', 'M':
+			keys = append(keys, KEY_MUTE)
+		case ']':
+			keys = append(keys, KEY_SPEED_UP)
+		case '[':
+			keys = append(keys, KEY_SPEED_DOWN)
+		case '+', '=':
+			keys = append(keys, KEY_AUDIO_DELAY_UP)
+		case '-':
+			keys = append(keys, KEY_AUDIO_DELAY_DOWN)
+		case 0x1b:
+			key, length := parseEscapeSequence(data[i:])
+			keys = append(keys, key)
+			i += length - 1
+		default:
+			keys = append(keys, KEY_UNKNOWN)
+		}
+	}
+	return keys
+}
+
+// Parses an escape sequence at the start of `data`
+// @returns the key and the length of the sequence
+func parseEscapeSequence(data []byte) (Key, int) {
+	// Arrow keys are sent as either CSI or SS3 sequences,
+	// depending on the cursor key mode of the terminal
+	if len(data) < 2 || (data[1] != '[' && data[1] != 'O') {
+		return KEY_UNKNOWN, 1
+	}
+
+	// Find the final byte of the sequence
+	end := 2
+	for end < len(data) && (data[end] < 0x40 || data[end] > 0x7e) {
+		end++
+	}
+	if end == len(data) {
+		return KEY_UNKNOWN, len(data)
+	}
+
+	switch data[end] {
+	case 'A':
+		return KEY_UP, end + 1
+	case 'B':
+		return KEY_DOWN, end + 1
+	case 'C':
+		return KEY_RIGHT, end + 1
+	case 'D':
+		return KEY_LEFT, end + 1
+	default:
+		return KEY_UNKNOWN, end + 1
+	}
+}
@@ -0,0 +1,47 @@
+// This file contains an encoder for the inline image protocol of iTerm2,
+// which is also supported by terminals like WezTerm.
+// Please see https://iterm2.com/documentation-images.html
+// for a description of the protocol.
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/jpeg"
+	"math"
+	"strconv"
+)
+
+// Quality of the JPEG images sent to the terminal.
+// JPEG is used instead of PNG because it is much faster to encode.
+const ITERM_JPEG_QUALITY = 85
+
+// Converts an image to an iTerm2 inline image escape sequence
+// that displays it at the cursor position.
+func imgToITerm(img image.Image) []byte {
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, img, &jpeg.Options{Quality: ITERM_JPEG_QUALITY}); err != nil {
+		logger.Error("iterm", "Failed to encode frame: %v", err)
+		return nil
+	}
+
+	// Size of the image in characters
+	cellWidth, cellHeight := termData.cellSize()
+	cols := max(1, int(math.Round(float64(img.Bounds().Dx())/cellWidth)))
+	rows := max(1, int(math.Round(float64(img.Bounds().Dy())/cellHeight)))
+
+	data := make([]byte, base64.StdEncoding.EncodedLen(encoded.Len()))
+	base64.StdEncoding.Encode(data, encoded.Bytes())
+
+	var buf bytes.Buffer
+	buf.Grow(len(data) + 128)
+	buf.WriteString("\033]1337;File=inline=1")
+	buf.WriteString(";size=" + strconv.Itoa(encoded.Len()))
+	buf.WriteString(";width=" + strconv.Itoa(cols) + ";height=" + strconv.Itoa(rows))
+	buf.WriteString(";preserveAspectRatio=1:")
+	buf.Write(data)
+	buf.WriteString("\a")
+	return buf.Bytes()
+}
@@ -0,0 +1,73 @@
+// This file contains an encoder for the kitty graphics protocol,
+// which is supported by terminals like kitty, Ghostty and WezTerm.
+// Please see https://sw.kovidgoyal.net/kitty/graphics-protocol/
+// for a description of the protocol.
+
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/base64"
+	"image"
+	"strconv"
+)
+
+// Id that every frame is transmitted with,
+// so that each frame replaces the previous one in place
+const KITTY_IMAGE_ID = 1
+
+// Maximum number of base64 bytes sent in one escape sequence
+const KITTY_CHUNK_SIZE = 4096
+
+// Converts an image to kitty graphics escape sequences
+// that transmit and display it at the cursor position.
+func imgToKitty(img image.Image) []byte {
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+
+	// Raw 24-bit RGB pixels
+	pixels := make([]byte, 0, width*height*3)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			r, g, b, _ := normalizeRGBA(img.At(x, y).RGBA())
+			pixels = append(pixels, byte(r), byte(g), byte(b))
+		}
+	}
+
+	// Compress the pixels, which greatly reduces the amount
+	// of data that has to be sent to the terminal
+	var compressed bytes.Buffer
+	w, _ := zlib.NewWriterLevel(&compressed, zlib.BestSpeed)
+	w.Write(pixels)
+	w.Close()
+
+	encoded := make([]byte, base64.StdEncoding.EncodedLen(compressed.Len()))
+	base64.StdEncoding.Encode(encoded, compressed.Bytes())
+
+	var buf bytes.Buffer
+	buf.Grow(len(encoded) + len(encoded)/KITTY_CHUNK_SIZE*8 + 64)
+	for start := 0; start < len(encoded); start += KITTY_CHUNK_SIZE {
+		end := min(start+KITTY_CHUNK_SIZE, len(encoded))
+		more := tern(end < len(encoded), "1", "0")
+
+		buf.WriteString("\033_G")
+		if start == 0 {
+			// The first chunk contains the parameters:
+			// transmit and display, 24-bit RGB, zlib compressed, no responses,
+			// don't move the cursor so the terminal doesn't scroll,
+			// and draw below text so subtitles are visible
+			buf.WriteString("a=T,f=24,o=z,q=2,C=1,z=-1")
+			buf.WriteString(",s=" + strconv.Itoa(width) + ",v=" + strconv.Itoa(height))
+			buf.WriteString(",i=" + strconv.Itoa(KITTY_IMAGE_ID) + ",p=1,")
+		}
+		buf.WriteString("m=" + more + ";")
+		buf.Write(encoded[start:end])
+		buf.WriteString("\033\\")
+	}
+	return buf.Bytes()
+}
+
+// Returns the escape sequence that deletes the image shown by `imgToKitty`
+func kittyDeleteImage() string {
+	return "\033_Ga=d,d=I,q=2,i=" + strconv.Itoa(KITTY_IMAGE_ID) + "\033\\"
+}
@@ -9,9 +9,12 @@ package main
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"image"
 	"math"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
@@ -19,18 +22,73 @@ import (
 	"github.com/asticode/go-astikit"
 )
 
+// A decoded video frame
+type VideoFrame struct {
+	img image.Image
+	// When the frame should be shown, relative to the start of the file
+	pts time.Duration
+	// The seek generation of the timer the frame was sent in, see `Timer.Generation`
+	generation uint64
+}
+
 // Decoder for a stream
 type StreamDecoder struct {
 	// The codec used to decode the stream
 	codec *astiav.Codec
 	// Context for the codec
 	codecContext *astiav.CodecContext
+	// The guessed frame rate of the stream
+	fps astiav.Rational
 	// Allocated space for a frame
 	frame *astiav.Frame
 	// The actual stream from the file
 	inputStream *astiav.Stream
 }
 
+// Allocates and opens a new codec context for the decoder
+func (d *StreamDecoder) openCodecContext() error {
+	// Allocate space for the decoding context
+	if d.codecContext = astiav.AllocCodecContext(d.codec); d.codecContext == nil {
+		return taggedErrf("loader", "failed to allocate decoder context")
+	}
+
+	// Create decoding context based on stream
+	if err := d.inputStream.CodecParameters().ToCodecContext(d.codecContext); err != nil {
+		return taggedErrf("loader", "failed to initialize decoding context: %w", err)
+	}
+
+	// Set framerate
+	if d.inputStream.CodecParameters().MediaType() == astiav.MediaTypeVideo {
+		d.codecContext.SetFramerate(d.fps)
+	}
+
+	// Open codec with context
+	if err := d.codecContext.Open(d.codec, nil); err != nil {
+		return taggedErrf("loader", "failed to open decoder with context: %w", err)
+	}
+
+	// // Set time base
+	d.codecContext.SetTimeBase(d.inputStream.TimeBase())
+
+	return nil
+}
+
+// Discards all data buffered in the decoder.
+// libav's avcodec_flush_buffers is not exposed by go-astiav,
+// so the codec context is recreated instead.
+func (d *StreamDecoder) flush() error {
+	d.closeCodecContext()
+	return d.openCodecContext()
+}
+
+// Frees the codec context of the decoder
+func (d *StreamDecoder) closeCodecContext() {
+	if d.codecContext != nil {
+		d.codecContext.Free()
+		d.codecContext = nil
+	}
+}
+
 // A loader that can load a file and send the frames
 // to the next part of the pipeline
 type MediaLoader struct {
@@ -44,29 +102,92 @@ type MediaLoader struct {
 	// Whether a file is open
 	isFileOpen bool
 	// Channel to send video frames to
-	videoOutput chan *image.Image
+	videoOutput chan *VideoFrame
 	// Channel to send audio frames to
 	audioOutput chan *AudioFrame
 	// Index of the selected video streams
 	selectedAudioStream int
 	// Index of the selected audio streams
 	selectedVideoStream int
+	// Whether the selected video stream is the cover art of an audio file,
+	// which is a single image that is shown by the visualizer
+	hasCoverArt bool
+	// Whether the file is a single image without audio, like a photo
+	isStillImage bool
+	// Indices of all audio streams, which can be switched between during playback
+	audioStreams []int
+	// Receives requests to switch to the next audio stream
+	audioStreamRequests chan struct{}
+	// Index of the selected subtitle stream, -1 if no subtitles are shown
+	selectedSubtitleStream int
+	// Select the streams by index or language, the first stream is used if empty
+	videoStreamSelector    string
+	audioStreamSelector    string
+	subtitleStreamSelector string
+	// The sample rate all audio is resampled to, which is the sample rate of the speaker.
+	// 0 to use the sample rate of the selected audio stream.
+	outputSampleRate int
+	// The sample rate the audio of the current file is sent with
+	audioSampleRate int
 
 	// Preallocated software resample context
 	swrCtx *astiav.SoftwareResampleContext
 	// Preallocated destination frame for audio resampling
 	swrDstFrame *astiav.Frame
 
+	// Receives the positions to seek to
+	seekRequests chan time.Duration
+	// A seek that was requested while sending a frame,
+	// to be executed once the current packet is processed
+	pendingSeek *time.Duration
+	// Frames before this position are discarded after seeking,
+	// because seeking only lands on the previous keyframe
+	seekTarget time.Duration
+	// Called after seeking with the new position,
+	// so that the rest of the pipeline can be flushed.
+	// Returns the seek generation that the following frames are sent with.
+	onSeek func(pos time.Duration) uint64
+	// The seek generation that video frames are sent with
+	generation uint64
+	// Called with the cover art or the still image once it is decoded
+	onStillImage func(img image.Image)
+
+	// The frame rate the video is sent with, 0 to use the frame rate of the file
+	outputFPS astiav.Rational
+	// Index of the next output frame when converting to `outputFPS`
+	nextOutputFrame int64
+	// Timestamp of the previous video frame, used for frames without a timestamp
+	lastVideoPts time.Duration
+	// When converting the frame rate, a frame is held back until the next one is decoded,
+	// as it is shown until the next one starts, which varies for variable frame rate files
+	heldVideoFrame    *astiav.Frame
+	hasHeldVideoFrame bool
+	heldVideoPts      time.Duration
+	// How long the held frame is shown if no frame follows it
+	heldVideoDuration time.Duration
+
 	// The player context to use for cancellation
 	pctx *PlayerContext
 }
 
 // Reset recreates the internal channels using passed parameters.
-func (l *MediaLoader) Reset(videoOutput chan *image.Image, audioOutput chan *AudioFrame) {
+func (l *MediaLoader) Reset(videoOutput chan *VideoFrame, audioOutput chan *AudioFrame) {
 	l.videoOutput = videoOutput
 	l.audioOutput = audioOutput
 	l.selectedAudioStream = -1
 	l.selectedVideoStream = -1
+	l.selectedSubtitleStream = -1
+	l.hasCoverArt = false
+	l.isStillImage = false
+	l.seekRequests = make(chan time.Duration, 1)
+	l.audioStreamRequests = make(chan struct{}, 4)
+	l.pendingSeek = nil
+	l.seekTarget = 0
+	l.generation = 0
+	l.outputFPS = astiav.Rational{}
+	l.nextOutputFrame = 0
+	l.lastVideoPts = 0
+	l.hasHeldVideoFrame = false
 }
 
 func validateExistance(filename string) error {
@@ -85,15 +206,190 @@ func validateExistance(filename string) error {
 	return nil
 }
 
+// Frame rate to assume for streams where it is unknown
+const DEFAULT_FPS = 25
+
 // Returns basic information about the file
-func (l *MediaLoader) GetInfo() (fps astiav.Rational, sampleRate int) {
-	fps = l.inputFormatContext.GuessFrameRate(l.streamDecoders[l.selectedVideoStream].inputStream, nil)
+func (l *MediaLoader) GetInfo() (sampleRate int) {
 	if l.selectedAudioStream == -1 {
-		sampleRate = -1
-	} else {
-		sampleRate = l.streamDecoders[l.selectedAudioStream].codecContext.SampleRate()
+		return -1
+	}
+	return l.audioSampleRate
+}
+
+// Returns whether the file has a video stream that is played as video.
+// Files without one only have audio, which is shown by the visualizer,
+// together with the cover art if there is one, or are a still image.
+func (l *MediaLoader) HasVideo() bool {
+	return l.selectedVideoStream != -1 && !l.hasCoverArt && !l.isStillImage
+}
+
+// Returns whether the file has cover art, see `HasVideo`
+func (l *MediaLoader) HasCoverArt() bool {
+	return l.hasCoverArt
+}
+
+// Returns whether the file is a still image without audio, see `HasVideo`
+func (l *MediaLoader) IsStillImage() bool {
+	return l.isStillImage
+}
+
+// Returns the value of a metadata entry of the file, like "title" or "artist".
+// Some formats store them with the audio stream instead.
+// @returns an empty string if the file has no such entry
+func (l *MediaLoader) Metadata(key string) string {
+	if value := dictionaryValue(l.inputFormatContext.Metadata(), key); value != "" {
+		return value
+	}
+	if l.selectedAudioStream != -1 {
+		return streamMetadata(l.inputFormatContext.Streams()[l.selectedAudioStream], key)
+	}
+	return ""
+}
+
+// Special values of the subtitle selector
+const (
+	SUBTITLES_AUTO = "auto"
+	SUBTITLES_OFF  = "off"
+)
+
+// Sets which streams are played from the files that are opened afterwards.
+// A selector is either the index of the stream or its language, like "eng".
+// If a selector is empty, the first stream of that type is played.
+// The subtitle selector can also be `SUBTITLES_OFF`.
+func (l *MediaLoader) SelectStreams(videoSelector string, audioSelector string, subtitleSelector string) {
+	l.videoStreamSelector = videoSelector
+	l.audioStreamSelector = audioSelector
+	l.subtitleStreamSelector = subtitleSelector
+}
+
+// Returns the value of a metadata entry of the stream, or an empty string
+func streamMetadata(stream *astiav.Stream, key string) string {
+	return dictionaryValue(stream.Metadata(), key)
+}
+
+// Returns the value of an entry of a metadata dictionary, or an empty string
+func dictionaryValue(metadata *astiav.Dictionary, key string) string {
+	if metadata == nil {
+		return ""
+	}
+	if entry := metadata.Get(key, nil, astiav.NewDictionaryFlags()); entry != nil {
+		return entry.Value()
+	}
+	return ""
+}
+
+// Codecs of images, which are used for cover art and photos
+var IMAGE_CODECS = []astiav.CodecID{
+	astiav.CodecIDMjpeg, astiav.CodecIDPng, astiav.CodecIDBmp, astiav.CodecIDGif,
+	astiav.CodecIDTiff, astiav.CodecIDWebp, astiav.CodecIDJpeg2000, astiav.CodecIDJpegls,
+}
+
+// Returns whether a video stream is a single image, like the cover art of a music file.
+// Cover art has no frame rate and at most one frame,
+// while MJPEG or PNG videos have a frame rate even if their length is unknown.
+func isStillImageStream(stream *astiav.Stream) bool {
+	codecID := stream.CodecParameters().CodecID()
+	if !slices.Contains(IMAGE_CODECS, codecID) {
+		return false
+	}
+	// Animated GIFs are played like a video
+	if codecID == astiav.CodecIDGif && stream.NbFrames() > 1 {
+		return false
 	}
-	return fps, sampleRate
+	return stream.AvgFrameRate().Num() == 0 && stream.NbFrames() <= 1
+}
+
+// Finds the stream of type `mediaType` matching `selector`, see `SelectStreams`
+// @returns -1 if the file has no stream of that type and no selector is given
+func (l *MediaLoader) findStream(mediaType astiav.MediaType, selector string) (int, error) {
+	streams := l.inputFormatContext.Streams()
+
+	if selector == "" {
+		for i, stream := range streams {
+			if stream.CodecParameters().MediaType() == mediaType {
+				return i, nil
+			}
+		}
+		return -1, nil
+	}
+
+	if index, err := strconv.Atoi(selector); err == nil {
+		if index < 0 || index >= len(streams) || streams[index].CodecParameters().MediaType() != mediaType {
+			return -1, taggedErrf("loader", "stream %d is not a %s stream", index, mediaType.String())
+		}
+		return index, nil
+	}
+
+	for i, stream := range streams {
+		if stream.CodecParameters().MediaType() == mediaType && strings.EqualFold(streamMetadata(stream, "language"), selector) {
+			return i, nil
+		}
+	}
+	return -1, taggedErrf("loader", "no %s stream with language \"%s\"", mediaType.String(), selector)
+}
+
+// Finds the subtitle stream matching `selector`, see `SelectStreams`.
+// Only text subtitles are supported.
+// @returns -1 if no subtitles should be shown
+func (l *MediaLoader) findSubtitleStream(selector string) (int, error) {
+	if selector == SUBTITLES_OFF {
+		return -1, nil
+	}
+
+	streams := l.inputFormatContext.Streams()
+	if selector == "" {
+		for i, stream := range streams {
+			if stream.CodecParameters().MediaType() == astiav.MediaTypeSubtitle && isTextSubtitle(stream.CodecParameters().CodecID()) {
+				return i, nil
+			}
+		}
+		return -1, nil
+	}
+
+	index, err := l.findStream(astiav.MediaTypeSubtitle, selector)
+	if err != nil {
+		return -1, err
+	}
+	if codecID := streams[index].CodecParameters().CodecID(); !isTextSubtitle(codecID) {
+		return -1, taggedErrf("loader", "subtitle stream %d has the format %s, only text subtitles are supported", index, codecID.Name())
+	}
+	return index, nil
+}
+
+// Prints the streams of a file with their codec, language and title
+func ListStreams(filename string) error {
+	if err := validateExistance(filename); err != nil {
+		return err
+	}
+
+	formatContext := astiav.AllocFormatContext()
+	if formatContext == nil {
+		return taggedErrf("loader", "failed to allocate input format context")
+	}
+	defer formatContext.Free()
+
+	if err := formatContext.OpenInput(filename, nil, nil); err != nil {
+		return taggedErrf("loader", "failed to open input file %q: %w", filename, err)
+	}
+	defer formatContext.CloseInput()
+
+	if err := formatContext.FindStreamInfo(nil); err != nil {
+		return taggedErrf("loader", "could not get information on streams in file: %w", err)
+	}
+
+	fmt.Println(filename + ":")
+	for i, stream := range formatContext.Streams() {
+		line := fmt.Sprintf("  %d: %s, %s", i, stream.CodecParameters().MediaType().String(), stream.CodecParameters().CodecID().Name())
+		if language := streamMetadata(stream, "language"); language != "" {
+			line += ", language: " + language
+		}
+		if title := streamMetadata(stream, "title"); title != "" {
+			line += ", title: " + title
+		}
+		fmt.Println(line)
+	}
+	return nil
 }
 
 // Opens a file and initializes the loader
@@ -128,6 +424,19 @@ func (l *MediaLoader) OpenFile(filename string) error {
 		return taggedErrf("loader", "could not get information on streams in file: %w", err)
 	}
 
+	// Choose the streams to play
+	var err error
+	if l.selectedVideoStream, err = l.findStream(astiav.MediaTypeVideo, l.videoStreamSelector); err != nil {
+		return err
+	}
+	if l.selectedAudioStream, err = l.findStream(astiav.MediaTypeAudio, l.audioStreamSelector); err != nil {
+		return err
+	}
+	if l.selectedSubtitleStream, err = l.findSubtitleStream(l.subtitleStreamSelector); err != nil {
+		return err
+	}
+	l.audioStreams = nil
+
 	// Loop through streams
 	for i, stream := range l.inputFormatContext.Streams() {
 		duration := stream.Duration()
@@ -137,12 +446,11 @@ func (l *MediaLoader) OpenFile(filename string) error {
 
 		switch streamType {
 		case astiav.MediaTypeAudio:
-			if l.selectedAudioStream == -1 {
-				l.selectedAudioStream = i
-			}
+			// Every audio stream gets a decoder, so that they can be switched between
+			l.audioStreams = append(l.audioStreams, i)
 		case astiav.MediaTypeVideo:
-			if l.selectedVideoStream == -1 {
-				l.selectedVideoStream = i
+			if i != l.selectedVideoStream {
+				continue
 			}
 		default:
 			// Skip other streams
@@ -150,37 +458,18 @@ func (l *MediaLoader) OpenFile(filename string) error {
 		}
 
 		// Create a new stream decoder
-		decoder := &StreamDecoder{inputStream: stream}
+		decoder := &StreamDecoder{inputStream: stream, fps: fps}
 		if decoder.codec = astiav.FindDecoder(stream.CodecParameters().CodecID()); decoder.codec == nil {
 			return taggedErrf("loader", "could not find decoder for stream %d", i)
 		}
 
 		logger.Info("loader", "Decoding with codec: %s", decoder.codec.Name())
 
-		// Allocate space for the decoding context
-		if decoder.codecContext = astiav.AllocCodecContext(decoder.codec); decoder.codecContext == nil {
-			return taggedErrf("loader", "failed to allocate decoder context")
-		}
-		l.closer.Add(decoder.codecContext.Free)
-
-		// Create decoding context based on stream
-		if err := stream.CodecParameters().ToCodecContext(decoder.codecContext); err != nil {
-			return taggedErrf("loader", "failed to initialize decoding context: %w", err)
-		}
-
-		// Set framerate
-		if stream.CodecParameters().MediaType() == astiav.MediaTypeVideo {
-			decoder.codecContext.SetFramerate(fps)
-		}
-
-		// Open codec with context
-		if err := decoder.codecContext.Open(decoder.codec, nil); err != nil {
-			return taggedErrf("loader", "failed to open decoder with context: %w", err)
+		l.closer.Add(decoder.closeCodecContext)
+		if err := decoder.openCodecContext(); err != nil {
+			return err
 		}
 
-		// // Set time base
-		decoder.codecContext.SetTimeBase(stream.TimeBase())
-
 		// Allocate frame
 		decoder.frame = astiav.AllocFrame()
 		l.closer.Add(decoder.frame.Free)
@@ -189,15 +478,35 @@ func (l *MediaLoader) OpenFile(filename string) error {
 		l.streamDecoders[i] = decoder
 	}
 
-	if l.selectedVideoStream == -1 {
-		return taggedErrf("loader", "no video stream found")
+	if l.selectedVideoStream == -1 && l.selectedAudioStream == -1 {
+		return taggedErrf("loader", "no video or audio stream found")
+	}
+	if l.selectedVideoStream != -1 && isStillImageStream(l.inputFormatContext.Streams()[l.selectedVideoStream]) {
+		l.hasCoverArt = l.selectedAudioStream != -1
+		l.isStillImage = l.selectedAudioStream == -1
+	}
+	logger.Info("loader", "Playing video stream %d, audio stream %d and subtitle stream %d", l.selectedVideoStream, l.selectedAudioStream, l.selectedSubtitleStream)
+
+	// All audio streams are resampled to the same sample rate,
+	// so that the speaker doesn't need to be reinitialized when switching
+	if l.selectedAudioStream != -1 {
+		l.audioSampleRate = l.outputSampleRate
+		if l.audioSampleRate == 0 {
+			l.audioSampleRate = l.streamDecoders[l.selectedAudioStream].codecContext.SampleRate()
+		}
+		logger.Info("loader", "Resampling audio from %d Hz to %d Hz", l.streamDecoders[l.selectedAudioStream].codecContext.SampleRate(), l.audioSampleRate)
 	}
 
 	l.swrCtx = astiav.AllocSoftwareResampleContext()
-	l.closer.Add(l.swrCtx.Free)
+	// The resample context is replaced when switching audio streams
+	l.closer.Add(func() { l.swrCtx.Free() })
 	l.swrDstFrame = astiav.AllocFrame()
 	l.closer.Add(l.swrDstFrame.Free)
 
+	l.heldVideoFrame = astiav.AllocFrame()
+	l.closer.Add(l.heldVideoFrame.Free)
+	l.hasHeldVideoFrame = false
+
 	// Init packet to read frames
 	l.packet = astiav.AllocPacket()
 	l.closer.Add(l.packet.Free)
@@ -213,18 +522,223 @@ func (l *MediaLoader) Close() {
 	l.streamDecoders = nil
 	l.selectedAudioStream = -1
 	l.selectedVideoStream = -1
+	l.selectedSubtitleStream = -1
+	l.hasCoverArt = false
+	l.isStillImage = false
+	l.audioStreams = nil
 	l.swrCtx = nil
 	l.swrDstFrame = nil
+	l.heldVideoFrame = nil
+	l.hasHeldVideoFrame = false
 	l.packet = nil
 
 	l.isFileOpen = false
 }
 
+// Requests the loader to seek to `pos`.
+// Replaces any seek request that hasn't been handled yet.
+func (l *MediaLoader) RequestSeek(pos time.Duration) {
+	for {
+		select {
+		case l.seekRequests <- pos:
+			return
+		default:
+			// Discard the old request
+			select {
+			case <-l.seekRequests:
+			default:
+			}
+		}
+	}
+}
+
+// Requests the loader to switch to the next audio stream of the file
+func (l *MediaLoader) RequestAudioStreamSwitch() {
+	select {
+	case l.audioStreamRequests <- struct{}{}:
+	default:
+		logger.Info("loader", "Dropping audio stream switch, too many pending")
+	}
+}
+
+// Switches to the next audio stream, without interrupting the video
+func (l *MediaLoader) switchAudioStream() {
+	if len(l.audioStreams) < 2 {
+		logger.Info("loader", "Not switching audio stream, there are %d audio streams", len(l.audioStreams))
+		return
+	}
+
+	next := l.audioStreams[0]
+	for i, index := range l.audioStreams {
+		if index == l.selectedAudioStream {
+			next = l.audioStreams[(i+1)%len(l.audioStreams)]
+		}
+	}
+
+	// The decoder may still contain data from when it was last used
+	if err := l.streamDecoders[next].flush(); err != nil {
+		logger.Error("loader", "Failed to flush decoder of stream %d: %v", next, err)
+		return
+	}
+
+	// The resample context is configured for the format of the old stream
+	l.swrCtx.Free()
+	l.swrCtx = astiav.AllocSoftwareResampleContext()
+
+	l.selectedAudioStream = next
+	logger.Info("loader", "Switched to audio stream %d", next)
+}
+
+// Converts a timestamp in the time base of `stream` to the position in the file
+func (l *MediaLoader) ptsToPosition(stream *astiav.Stream, pts int64) time.Duration {
+	pos := time.Duration(astiav.RescaleQ(pts, stream.TimeBase(), astiav.NewRational(1, int(time.Second))))
+	if start := l.inputFormatContext.StartTime(); start != astiav.NoPtsValue {
+		pos -= time.Duration(astiav.RescaleQ(start, astiav.TimeBaseQ, astiav.NewRational(1, int(time.Second))))
+	}
+	return pos
+}
+
+// Returns whether the current frame of `decoder` lies before the seek target
+func (l *MediaLoader) isBeforeSeekTarget(decoder *StreamDecoder) bool {
+	pts := decoder.frame.Pts()
+	if l.seekTarget == 0 || pts == astiav.NoPtsValue {
+		return false
+	}
+	return l.ptsToPosition(decoder.inputStream, pts) < l.seekTarget
+}
+
+// Seeks to `pos` and flushes the decoders and the rest of the pipeline
+func (l *MediaLoader) seek(pos time.Duration) {
+	pos = max(pos, 0)
+	if duration := l.inputFormatContext.Duration(); duration > 0 && duration != astiav.NoPtsValue {
+		pos = min(pos, time.Duration(astiav.RescaleQ(duration, astiav.TimeBaseQ, astiav.NewRational(1, int(time.Second)))))
+	}
+	logger.Info("loader", "Seeking to %s", pos)
+
+	timestamp := astiav.RescaleQ(int64(pos), astiav.NewRational(1, int(time.Second)), astiav.TimeBaseQ)
+	if start := l.inputFormatContext.StartTime(); start != astiav.NoPtsValue {
+		timestamp += start
+	}
+
+	// Seek backwards so that we land on the keyframe before the position
+	if err := l.inputFormatContext.SeekFrame(-1, timestamp, astiav.NewSeekFlags(astiav.SeekFlagBackward)); err != nil {
+		logger.Error("loader", "Failed to seek to %s: %v", pos, err)
+		return
+	}
+
+	for i, decoder := range l.streamDecoders {
+		if err := decoder.flush(); err != nil {
+			logger.Error("loader", "Failed to flush decoder of stream %d: %v", i, err)
+		}
+	}
+
+	l.seekTarget = pos
+	l.nextOutputFrame = 0
+	l.lastVideoPts = pos
+	l.discardHeldVideoFrame()
+	if l.onSeek != nil {
+		l.generation = l.onSeek(pos)
+	}
+}
+
+// Sets the frame rate the video is sent with.
+// Frames are dropped or repeated to convert from the frame rate of the file.
+// A frame rate of 0 sends every frame exactly once.
+func (l *MediaLoader) SetOutputFPS(fps astiav.Rational) {
+	l.outputFPS = fps
+}
+
+// Sets the sample rate the audio is sent with.
+// The audio of every file is resampled to it,
+// so that files with different sample rates can be played after each other.
+// A sample rate of 0 sends the audio with the sample rate of the file.
+func (l *MediaLoader) SetOutputSampleRate(sampleRate int) {
+	l.outputSampleRate = sampleRate
+}
+
+// Returns the position of the current frame of `decoder`.
+// Frames without a timestamp are placed one frame after the previous one.
+func (l *MediaLoader) videoFramePosition(decoder *StreamDecoder) time.Duration {
+	if pts := decoder.frame.Pts(); pts != astiav.NoPtsValue {
+		l.lastVideoPts = l.ptsToPosition(decoder.inputStream, pts)
+	} else {
+		l.lastVideoPts += frameDuration(decoder.fps)
+	}
+	return l.lastVideoPts
+}
+
+// Returns how long a frame is shown at the given frame rate
+func frameDuration(fps astiav.Rational) time.Duration {
+	if fps.Num() == 0 || fps.Den() == 0 {
+		return time.Second / DEFAULT_FPS
+	}
+	return time.Duration(float64(time.Second) / fps.Float64())
+}
+
+// Calculates at which timestamps a frame starting at `pts` that is shown for `duration`
+// has to be sent to match the output frame rate.
+// @returns no timestamps if the frame should be dropped
+func (l *MediaLoader) outputTimestamps(pts time.Duration, duration time.Duration) []time.Duration {
+	// The frame is shown for every output frame that starts
+	// while it is shown, in the range [pts, pts+duration)
+	interval := frameDuration(l.outputFPS)
+	first := int64(math.Ceil(float64(pts) / float64(interval)))
+	end := int64(math.Ceil(float64(pts+duration) / float64(interval)))
+	first = max(first, l.nextOutputFrame)
+
+	timestamps := make([]time.Duration, 0, max(end-first, 0))
+	for i := first; i < end; i++ {
+		timestamps = append(timestamps, time.Duration(i)*interval)
+	}
+	l.nextOutputFrame = max(l.nextOutputFrame, end)
+	return timestamps
+}
+
+// Sends the held video frame, which is shown until the current frame of `decoder` starts at `pts`,
+// and holds the current frame instead.
+// This is only used when converting the frame rate.
+func (l *MediaLoader) holdVideoFrame(decoder *StreamDecoder, pts time.Duration) {
+	l.sendHeldVideoFrame(pts)
+
+	if err := l.heldVideoFrame.Ref(decoder.frame); err != nil {
+		logger.Error("loader", "Skipping frame because it could not be held: %v", err)
+		return
+	}
+	l.hasHeldVideoFrame = true
+	l.heldVideoPts = pts
+	l.heldVideoDuration = frameDuration(decoder.fps)
+}
+
+// Sends the held video frame, if there is one, which is shown until `end`
+func (l *MediaLoader) sendHeldVideoFrame(end time.Duration) {
+	if !l.hasHeldVideoFrame {
+		return
+	}
+	defer l.discardHeldVideoFrame()
+
+	// Drop frames before they are converted if possible
+	timestamps := l.outputTimestamps(l.heldVideoPts, end-l.heldVideoPts)
+	if len(timestamps) == 0 {
+		logger.Debug("loader", "Dropped frame to match the output fps")
+		return
+	}
+	l.sendVideoFrame(l.heldVideoFrame.Data(), timestamps)
+}
+
+// Discards the held video frame, like after seeking
+func (l *MediaLoader) discardHeldVideoFrame() {
+	if l.hasHeldVideoFrame {
+		l.heldVideoFrame.Unref()
+		l.hasHeldVideoFrame = false
+	}
+}
+
 // Convert the given frame to an image
 // and send it to the output channel
 //
 // @param data the frame data to convert
-func (l *MediaLoader) sendVideoFrame(data *astiav.FrameData) {
+// @param timestamps the timestamps the image should be sent with
+func (l *MediaLoader) sendVideoFrame(data *astiav.FrameData, timestamps []time.Duration) {
 	img, err := data.GuessImageFormat()
 	if err != nil {
 		logger.Error("loader", "Skipping frame because guessing image format failed: %v", err)
@@ -235,52 +749,105 @@ func (l *MediaLoader) sendVideoFrame(data *astiav.FrameData) {
 		return
 	}
 
-	// Send the image to the output channel, or close if the context is done
-	select {
-	case <-l.pctx.ctx.Done():
-		// Abort work prematurely
+	for _, pts := range timestamps {
+		// Send the image to the output channel, or close if the context is done
+		select {
+		case <-l.pctx.ctx.Done():
+			// Abort work prematurely
+			return
+		case pos := <-l.seekRequests:
+			// Abandon the frame so that the seek can be executed
+			l.pendingSeek = &pos
+			return
+		case l.videoOutput <- &VideoFrame{img: img, pts: pts, generation: l.generation}:
+			logger.Debug("loader", "Sent video frame")
+		}
+	}
+}
+
+// Converts the cover art or still image to an image and passes it to `onStillImage`.
+// It isn't sent to the output channel, as it is shown for longer than one frame.
+func (l *MediaLoader) sendStillImage(data *astiav.FrameData) {
+	img, err := data.GuessImageFormat()
+	if err != nil {
+		logger.Error("loader", "Skipping still image because guessing image format failed: %v", err)
+		return
+	}
+	if err := data.ToImage(img); err != nil {
+		logger.Error("loader", "Skipping still image because image conversion failed: %v", err)
 		return
-	case l.videoOutput <- &img:
-		logger.Debug("loader", "Sent video frame")
+	}
+	logger.Info("loader", "Decoded still image with size %dx%d", img.Bounds().Dx(), img.Bounds().Dy())
+	if l.onStillImage != nil {
+		l.onStillImage(img)
 	}
 }
 
+// Size of a packed stereo sample with two float64 values
+const STEREO_SAMPLE_SIZE = 16
+
+// Resamples an audio frame to stereo samples at `sampleRate`.
+// The frame data will be in an unknown format.
+// In order to use it with beep, we need to convert it to [][2]float64.
+// We can do this with libswresample by converting the frame to AV_SAMPLE_FMT_DBL with a stereo layout.
+// see https://ffmpeg.org/doxygen/7.0/group__lavu__sampfmts.html#gaf9a51ca15301871723577c730b5865c5
+// for a list of sample formats.
+// Mono is played on both channels and surround sound is downmixed
+// with the default mixing levels of libswresample.
+//
+// @param swrCtx the resample context, which configures itself on the first frame
+// @param dst a frame to store the resampled data in
+// @param frame the frame to convert, or nil to flush the samples buffered in `swrCtx`
+func resampleAudioFrame(swrCtx *astiav.SoftwareResampleContext, dst *astiav.Frame, frame *astiav.Frame, sampleRate int) (AudioFrame, error) {
+	// Free the previous buffer, so that ConvertFrame allocates one
+	// that is large enough for this frame
+	dst.Unref()
+	dst.SetSampleFormat(astiav.SampleFormatDbl)
+	dst.SetChannelLayout(astiav.ChannelLayoutStereo)
+	dst.SetSampleRate(sampleRate)
+
+	if err := swrCtx.ConvertFrame(frame, dst); err != nil {
+		return nil, err
+	}
+	if dst.NbSamples() == 0 {
+		// The resampler can hold back samples when converting the sample rate
+		return AudioFrame{}, nil
+	}
+
+	data, err := dst.Data().Bytes(0)
+	if err != nil {
+		return nil, err
+	}
+	return stereoSamplesFromBytes(data, dst.NbSamples()), nil
+}
+
+// Converts packed stereo float64 samples to `count` samples for beep
+func stereoSamplesFromBytes(data []byte, count int) AudioFrame {
+	count = min(count, len(data)/STEREO_SAMPLE_SIZE)
+	audioData := make(AudioFrame, count)
+	for i := range audioData {
+		sample := data[i*STEREO_SAMPLE_SIZE : (i+1)*STEREO_SAMPLE_SIZE]
+		left := math.Float64frombits(binary.LittleEndian.Uint64(sample[0:8]))
+		right := math.Float64frombits(binary.LittleEndian.Uint64(sample[8:16]))
+		audioData[i] = [2]float64{left, right}
+	}
+	return audioData
+}
+
 // Convert the given frame to compatible audio data
 // and send it to the output channel
 //
 // @param frame the frame to convert
 func (l *MediaLoader) sendAudioFrame(frame *astiav.Frame) {
-	// The frame data will be in an unknown format.
-	// In order to use it with beep, we need to convert it to [][2]float64.
-	// We can do this with libswresample by converting the frame to AV_SAMPLE_FMT_DBL.
-	// see https://ffmpeg.org/doxygen/7.0/group__lavu__sampfmts.html#gaf9a51ca15301871723577c730b5865c5
-	// for a list of sample formats.
-
 	start := time.Now()
 
-	l.swrDstFrame.SetSampleFormat(astiav.SampleFormatDbl)
-	l.swrDstFrame.SetChannelLayout(frame.ChannelLayout())
-	l.swrDstFrame.SetSampleRate(frame.SampleRate())
-
-	// No need to allocate data buffer, it will be done by ConvertFrame
-	l.swrCtx.ConvertFrame(
-		frame,
-		l.swrDstFrame,
-	)
-
-	// Get the data
-	data, err := l.swrDstFrame.Data().Bytes(0)
+	audioData, err := resampleAudioFrame(l.swrCtx, l.swrDstFrame, frame, l.audioSampleRate)
 	if err != nil {
-		logger.Error("loader", "Skipping frame because could not get audio frame data: %v", err)
+		logger.Error("loader", "Skipping frame because resampling failed: %v", err)
 		return
 	}
-
-	// Convert the data to a slice of [][2]float64
-	audioData := make(AudioFrame, len(data)/16)
-	for i := 0; i < len(data); i += 16 {
-		left := math.Float64frombits(binary.LittleEndian.Uint64(data[i : i+8]))
-		right := math.Float64frombits(binary.LittleEndian.Uint64(data[i+8 : i+16]))
-		audioData[i/16] = [2]float64{left, right}
+	if len(audioData) == 0 {
+		return
 	}
 
 	logger.Debug("loader", "Converted audio frame in %s", time.Since(start))
@@ -290,11 +857,35 @@ func (l *MediaLoader) sendAudioFrame(frame *astiav.Frame) {
 	case <-l.pctx.ctx.Done():
 		// Abort work prematurely
 		return
+	case pos := <-l.seekRequests:
+		// Abandon the frame so that the seek can be executed
+		l.pendingSeek = &pos
 	case l.audioOutput <- &audioData:
 		logger.Debug("loader", "Sent audio frame")
 	}
 }
 
+// Adds the subtitle in the current packet to the subtitles of the file
+func (l *MediaLoader) addSubtitle() {
+	stream := l.inputFormatContext.Streams()[l.selectedSubtitleStream]
+	if l.packet.Pts() == astiav.NoPtsValue {
+		logger.Error("loader", "Skipping subtitle without timestamp")
+		return
+	}
+
+	start := l.ptsToPosition(stream, l.packet.Pts())
+	duration := DEFAULT_SUBTITLE_DURATION
+	if d := l.packet.Duration(); d > 0 {
+		duration = time.Duration(astiav.RescaleQ(d, stream.TimeBase(), astiav.NewRational(1, int(time.Second))))
+	}
+
+	l.pctx.subtitles.Add(Subtitle{
+		start: start,
+		end:   start + duration,
+		text:  subtitlePacketText(stream.CodecParameters().CodecID(), l.packet.Data()),
+	})
+}
+
 // Receive a frame from the decoder and send it to the output channel
 //
 // @param decoder the decoder to receive the frame from
@@ -314,10 +905,22 @@ func (l *MediaLoader) receiveFrame(decoder *StreamDecoder) bool {
 	}
 	defer decoder.frame.Unref()
 
+	if l.pendingSeek != nil || l.isBeforeSeekTarget(decoder) {
+		// The frame would be discarded anyway
+		return true
+	}
+
 	// Get image
-	if decoder.inputStream.CodecParameters().MediaType() == astiav.MediaTypeVideo {
-		data := decoder.frame.Data()
-		l.sendVideoFrame(data)
+	if (l.hasCoverArt || l.isStillImage) && decoder.inputStream.CodecParameters().MediaType() == astiav.MediaTypeVideo {
+		l.sendStillImage(decoder.frame.Data())
+	} else if decoder.inputStream.CodecParameters().MediaType() == astiav.MediaTypeVideo {
+		pts := l.videoFramePosition(decoder)
+		if l.outputFPS.Num() == 0 {
+			l.sendVideoFrame(decoder.frame.Data(), []time.Duration{pts})
+		} else {
+			// How long the frame is shown is only known once the next frame is decoded
+			l.holdVideoFrame(decoder, pts)
+		}
 	} else {
 		l.sendAudioFrame(decoder.frame)
 	}
@@ -340,11 +943,20 @@ func (l *MediaLoader) processPacket() bool {
 	}
 	defer l.packet.Unref()
 
+	if l.packet.StreamIndex() == l.selectedSubtitleStream {
+		l.addSubtitle()
+		return true
+	}
+
 	decoder, ok := l.streamDecoders[l.packet.StreamIndex()]
 	if !ok {
 		logger.Error("loader", "Packet does not belong to a valid stream, skipping")
 		return true
 	}
+	if decoder.inputStream.CodecParameters().MediaType() == astiav.MediaTypeAudio && l.packet.StreamIndex() != l.selectedAudioStream {
+		// Only the selected audio stream is decoded
+		return true
+	}
 
 	// Send packet to decoder
 	if err := decoder.codecContext.SendPacket(l.packet); err != nil {
@@ -370,16 +982,30 @@ func (l *MediaLoader) Start() error {
 	for {
 		start := time.Now()
 
+		if l.pendingSeek != nil {
+			l.seek(*l.pendingSeek)
+			l.pendingSeek = nil
+		}
+
 		select {
 		case <-l.pctx.ctx.Done():
 			l.Close()
 			logger.Info("loader", "Stopped")
 			return nil
+		case pos := <-l.seekRequests:
+			l.seek(pos)
+		case <-l.audioStreamRequests:
+			l.switchAudioStream()
 		default:
 			if !l.processPacket() {
 				// No more packets available
+				l.sendHeldVideoFrame(l.heldVideoPts + l.heldVideoDuration)
+				// Without a video stream, the video frames come from the visualizer
+				hasVideo := l.HasVideo()
 				l.Close()
-				close(l.videoOutput)
+				if hasVideo {
+					close(l.videoOutput)
+				}
 				close(l.audioOutput)
 				logger.Info("loader", "Finished loading")
 				return nil
@@ -403,14 +1029,15 @@ func NewMediaLoader(pctx *PlayerContext) *MediaLoader {
 	})
 
 	loader := &MediaLoader{
-		inputFormatContext:  nil,
-		closer:              nil,
-		streamDecoders:      nil,
-		isFileOpen:          false,
-		packet:              nil,
-		selectedAudioStream: -1,
-		selectedVideoStream: -1,
-		pctx:                pctx,
+		inputFormatContext:     nil,
+		closer:                 nil,
+		streamDecoders:         nil,
+		isFileOpen:             false,
+		packet:                 nil,
+		selectedAudioStream:    -1,
+		selectedVideoStream:    -1,
+		selectedSubtitleStream: -1,
+		pctx:                   pctx,
 	}
 
 	return loader
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"github.com/asticode/go-astiav"
+)
+
+const TEST_SAMPLE_RATE = 48000
+const TEST_FRAME_SAMPLES = 1024
+
+func init() {
+	// The loader logs while resampling
+	logger = NewLogger()
+}
+
+// Creates a planar float64 audio frame with `value(channel, i)` as the samples
+func newTestAudioFrame(t *testing.T, layout astiav.ChannelLayout, sampleRate int, value func(channel, i int) float64) *astiav.Frame {
+	t.Helper()
+
+	frame := astiav.AllocFrame()
+	t.Cleanup(frame.Free)
+	frame.SetSampleFormat(astiav.SampleFormatDblp)
+	frame.SetChannelLayout(layout)
+	frame.SetSampleRate(sampleRate)
+	frame.SetNbSamples(TEST_FRAME_SAMPLES)
+	if err := frame.AllocBuffer(0); err != nil {
+		t.Fatalf("allocating frame buffer failed: %v", err)
+	}
+
+	// One plane per channel
+	data := make([]byte, 0, layout.Channels()*TEST_FRAME_SAMPLES*8)
+	for channel := 0; channel < layout.Channels(); channel++ {
+		for i := 0; i < TEST_FRAME_SAMPLES; i++ {
+			data = binary.LittleEndian.AppendUint64(data, math.Float64bits(value(channel, i)))
+		}
+	}
+	if err := frame.Data().SetBytes(data, 1); err != nil {
+		t.Fatalf("setting frame data failed: %v", err)
+	}
+	return frame
+}
+
+// Resamples a single frame with a new resample context
+func resampleTestFrame(t *testing.T, frame *astiav.Frame, sampleRate int) AudioFrame {
+	t.Helper()
+
+	swrCtx := astiav.AllocSoftwareResampleContext()
+	t.Cleanup(swrCtx.Free)
+	dst := astiav.AllocFrame()
+	t.Cleanup(dst.Free)
+
+	samples, err := resampleAudioFrame(swrCtx, dst, frame, sampleRate)
+	if err != nil {
+		t.Fatalf("resampling failed: %v", err)
+	}
+	return samples
+}
+
+func assertNear(t *testing.T, name string, got, want float64) {
+	t.Helper()
+	if math.Abs(got-want) > 1e-6 {
+		t.Errorf("%s: got %f, want %f", name, got, want)
+	}
+}
+
+func TestResampleMono(t *testing.T) {
+	frame := newTestAudioFrame(t, astiav.ChannelLayoutMono, TEST_SAMPLE_RATE, func(channel, i int) float64 {
+		return 0.5
+	})
+	samples := resampleTestFrame(t, frame, TEST_SAMPLE_RATE)
+
+	// Mono used to be read as stereo pairs, which halved the number of samples
+	if len(samples) != TEST_FRAME_SAMPLES {
+		t.Fatalf("got %d samples, want %d", len(samples), TEST_FRAME_SAMPLES)
+	}
+	for i, sample := range samples {
+		if sample[0] != sample[1] {
+			t.Fatalf("sample %d: left %f and right %f differ", i, sample[0], sample[1])
+		}
+		if sample[0] <= 0.3 || sample[0] > 0.5+1e-6 {
+			t.Fatalf("sample %d: got %f, want the mono signal with at most unity gain", i, sample[0])
+		}
+	}
+}
+
+func TestResampleStereo(t *testing.T) {
+	frame := newTestAudioFrame(t, astiav.ChannelLayoutStereo, TEST_SAMPLE_RATE, func(channel, i int) float64 {
+		return []float64{0.25, -0.75}[channel]
+	})
+	samples := resampleTestFrame(t, frame, TEST_SAMPLE_RATE)
+
+	if len(samples) != TEST_FRAME_SAMPLES {
+		t.Fatalf("got %d samples, want %d", len(samples), TEST_FRAME_SAMPLES)
+	}
+	for _, sample := range samples {
+		assertNear(t, "left", sample[0], 0.25)
+		assertNear(t, "right", sample[1], -0.75)
+	}
+}
+
+func TestResampleSurround(t *testing.T) {
+	// Channels of 5.1: front left, front right, center, LFE, side left, side right
+	tests := []struct {
+		name    string
+		channel int
+		// Whether the channel should be heard on the left and right
+		left, right bool
+	}{
+		{"front left", 0, true, false},
+		{"front right", 1, false, true},
+		{"center", 2, true, true},
+		{"side left", 4, true, false},
+		{"side right", 5, false, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			frame := newTestAudioFrame(t, astiav.ChannelLayout5Point1, TEST_SAMPLE_RATE, func(channel, i int) float64 {
+				return tern(channel == test.channel, 0.5, 0.0)
+			})
+			samples := resampleTestFrame(t, frame, TEST_SAMPLE_RATE)
+
+			if len(samples) != TEST_FRAME_SAMPLES {
+				t.Fatalf("got %d samples, want %d", len(samples), TEST_FRAME_SAMPLES)
+			}
+			sample := samples[len(samples)/2]
+			if (math.Abs(sample[0]) > 1e-6) != test.left || (math.Abs(sample[1]) > 1e-6) != test.right {
+				t.Errorf("got left %f and right %f, want left: %t, right: %t", sample[0], sample[1], test.left, test.right)
+			}
+			if test.left && test.right {
+				assertNear(t, "right", sample[1], sample[0])
+			}
+			// Surround sound used to be read as stereo pairs, which produced noise
+			if math.Abs(sample[0]) > 0.5+1e-6 || math.Abs(sample[1]) > 0.5+1e-6 {
+				t.Errorf("got left %f and right %f, which are louder than the input", sample[0], sample[1])
+			}
+		})
+	}
+}
+
+func TestResampleSampleRate(t *testing.T) {
+	const sourceRate = 44100
+	const frameCount = 20
+
+	swrCtx := astiav.AllocSoftwareResampleContext()
+	defer swrCtx.Free()
+	dst := astiav.AllocFrame()
+	defer dst.Free()
+
+	total := 0
+	for range frameCount {
+		frame := newTestAudioFrame(t, astiav.ChannelLayoutStereo, sourceRate, func(channel, i int) float64 {
+			return 0.1
+		})
+		samples, err := resampleAudioFrame(swrCtx, dst, frame, TEST_SAMPLE_RATE)
+		if err != nil {
+			t.Fatalf("resampling failed: %v", err)
+		}
+		total += len(samples)
+	}
+
+	// Flush the samples held back by the resampler
+	samples, err := resampleAudioFrame(swrCtx, dst, nil, TEST_SAMPLE_RATE)
+	if err != nil {
+		t.Fatalf("flushing failed: %v", err)
+	}
+	total += len(samples)
+
+	want := frameCount * TEST_FRAME_SAMPLES * TEST_SAMPLE_RATE / sourceRate
+	if math.Abs(float64(total-want)) > 2 {
+		t.Errorf("got %d samples, want about %d", total, want)
+	}
+}
+
+func TestStereoSamplesFromBytes(t *testing.T) {
+	var data []byte
+	for _, v := range []float64{0.1, -0.2, 0.3, -0.4} {
+		data = binary.LittleEndian.AppendUint64(data, math.Float64bits(v))
+	}
+
+	samples := stereoSamplesFromBytes(data, 2)
+	if len(samples) != 2 {
+		t.Fatalf("got %d samples, want 2", len(samples))
+	}
+	if samples[0] != [2]float64{0.1, -0.2} || samples[1] != [2]float64{0.3, -0.4} {
+		t.Errorf("got %v, want [[0.1 -0.2] [0.3 -0.4]]", samples)
+	}
+
+	// A count larger than the data must not read past its end
+	if samples := stereoSamplesFromBytes(data, 5); len(samples) != 2 {
+		t.Errorf("got %d samples for a too large count, want 2", len(samples))
+	}
+}
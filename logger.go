@@ -37,6 +37,12 @@ func NewLogger() *Logger {
 	}
 }
 
+// Returns whether messages of `level` are written,
+// so that expensive values are only computed for them if needed
+func (l *Logger) Enabled(level int) bool {
+	return l.level != NONE && l.level >= level
+}
+
 func (l *Logger) log(level int, levelTag string, tag string, format string, v ...any) {
 	if l.level >= level {
 		msg := fmt.Sprintf(format, v...)
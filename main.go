@@ -5,6 +5,7 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"time"
 )
 
 const VERSION = "0.2.0"
@@ -30,14 +31,49 @@ var (
 
 var CHARS []rune
 
+// How images are converted to characters
+type RenderMode int
+
+const (
+	RENDER_CHARS      RenderMode = iota // One character per pixel, chosen by brightness
+	RENDER_HALF_BLOCK                   // Two colored pixels per character using half blocks
+	RENDER_BRAILLE                      // 2x4 black and white pixels per character using braille
+)
+
+var renderMode RenderMode
+
+// Where the converted images are sent to
+type OutputMode int
+
+const (
+	OUTPUT_TEXT  OutputMode = iota // Characters, see `RenderMode`
+	OUTPUT_SIXEL                   // Sixel graphics
+	OUTPUT_KITTY                   // Kitty graphics protocol
+	OUTPUT_ITERM                   // iTerm2 inline images
+)
+
+var outputMode OutputMode
+
 // Command Line Argument
 var (
-	ratio        uint
-	allowResize  bool
-	userWidth    uint
-	userHeight   uint
-	userFPS      uint
-	colorEnabled bool
+	ratio            uint
+	allowResize      bool
+	userWidth        uint
+	userHeight       uint
+	userFPS          uint
+	userSampleRate   uint
+	colorEnabled     bool
+	frameDropEnabled bool
+	userVolume       float64
+	startMuted       bool
+	userSpeed        float64
+	userAudioDelay   time.Duration
+	userDuration     time.Duration
+	listStreams      bool
+	userVideoStream  string
+	userAudioStream  string
+	userSubtitles    string
+	userSubtitleFile string
 )
 
 // Contains the current terminal size
@@ -62,6 +98,11 @@ func (e QuietError) Error() string {
 // @returns the filenames of the video files to play
 func parseArgs() ([]string, error) {
 	var userChars string
+	var userOutput string
+	var userColors string
+	var userDither string
+	var userSync string
+	var userVisualizer string
 	var logLevel string
 	var showHelp bool
 	var showVersion bool
@@ -69,11 +110,28 @@ func parseArgs() ([]string, error) {
 	flag.BoolVar(&allowResize, "resize", true, "Resize the video if the terminal size changes")
 	flag.UintVar(&userWidth, "width", 0, "Width of video. Will be calculated automatically based on the terminal size if not set or set to 0. Maintains aspect ratio.")
 	flag.UintVar(&userHeight, "height", 0, "Height of video. Will be calculated automatically based on the terminal size if not set or set to 0. Maintains aspect ratio.")
-	flag.UintVar(&userFPS, "fps", 0, "FPS with which the video should be played the video. Defaults to the video's fps.")
-	flag.StringVar(&userChars, "ch", "ascii", "Character set, options are: \"ascii\", \"ascii_no_space\", \"block\" and \"filled\"")
+	flag.UintVar(&userFPS, "fps", 0, "FPS with which the video should be played. Frames are dropped or repeated to keep the video in sync. Defaults to the video's fps.")
+	flag.UintVar(&userSampleRate, "samplerate", DEFAULT_SAMPLE_RATE, "Sample rate of the audio output in Hz. The audio of every file is resampled to it.")
+	flag.Float64Var(&userVolume, "volume", 0, "Volume in decibels relative to the volume of the file, like -6 for half as loud. Can be changed with \"9\" and \"0\" during playback.")
+	flag.BoolVar(&startMuted, "mute", false, "Start with the audio muted. Press \"m\" during playback to unmute.")
+	flag.Float64Var(&userSpeed, "speed", 1, "Playback speed, like 1.5 to play one and a half times as fast. The pitch of the audio stays the same. Can be changed with \"[\" and \"]\" during playback.")
+	flag.DurationVar(&userAudioDelay, "audio-delay", 0, "How much later the audio is played than the video, like 300ms. Negative values play the audio earlier. Can be changed with \"+\" and \"-\" during playback.")
+	flag.DurationVar(&userDuration, "duration", 0, "How long images like photos are shown, like 5s. By default they are shown until a key is pressed.")
+	flag.StringVar(&userChars, "ch", "ascii", "Character set, options are: \"ascii\", \"ascii_no_space\", \"block\", \"filled\", \"half\" and \"braille\". \"half\" uses colored half blocks (▀) to double the vertical resolution, \"braille\" uses braille characters (⣿) with 2x4 dots each.")
+	flag.StringVar(&userOutput, "output", "text", "Output mode, options are: \"text\", \"sixel\", \"kitty\" and \"iterm\". \"sixel\", \"kitty\" and \"iterm\" show real pixels on terminals that support sixel graphics, the kitty graphics protocol or iTerm2 inline images.")
 	flag.BoolVar(&showHelp, "h", false, "Show this help text")
 	flag.StringVar(&logLevel, "log", "none", "Log level, options are: \"none\", \"info\", \"debug\", \"error\". Default is \"none\". If set to something different to \"none\", logs will be written to a file called \"log.txt\"")
 	flag.BoolVar(&colorEnabled, "c", false, "Enable color output")
+	flag.StringVar(&userColors, "colors", "auto", "Colors supported by the terminal, options are: \"auto\", \"truecolor\", \"256\" and \"16\". \"auto\" detects them from the COLORTERM and TERM environment variables.")
+	flag.StringVar(&userDither, "dither", "ordered", "Dithering, options are: \"none\", \"ordered\", \"floyd-steinberg\" and \"atkinson\". Dithering hides the bands that appear when there are only a few characters or colors. \"ordered\" doesn't flicker between frames, the others are more accurate.")
+	flag.StringVar(&userSync, "sync", "video", "Clock the playback is synchronized to, options are: \"video\" and \"audio\". With \"video\", the audio skips ahead or waits when the video is late, with \"audio\", the audio plays without interruptions and the video drops frames to follow it.")
+	flag.StringVar(&userVisualizer, "vis", "spectrum", "Visualization shown for files without video, options are: \"spectrum\", \"wave\" and \"vu\". \"spectrum\" shows the loudness of each frequency range, \"wave\" the waveform and \"vu\" the loudness of each channel.")
+	flag.BoolVar(&frameDropEnabled, "framedrop", true, "Drop frames that are too late to be shown in time, so that the video keeps up with the audio")
+	flag.BoolVar(&listStreams, "list-streams", false, "List the streams of the files with their index, codec, language and title, instead of playing them")
+	flag.StringVar(&userVideoStream, "video-stream", "", "Video stream to play, either its index or its language (like \"eng\"). Defaults to the first video stream.")
+	flag.StringVar(&userAudioStream, "audio-stream", "", "Audio stream to play, either its index or its language (like \"eng\"). Defaults to the first audio stream. Press \"a\" during playback to switch to the next audio stream.")
+	flag.StringVar(&userSubtitles, "subs", SUBTITLES_AUTO, "Subtitles to show, options are: \"auto\", \"off\", or the index or language of a subtitle stream. \"auto\" shows a .srt or .vtt file with the same name as the video if there is one, and the first text subtitle stream otherwise.")
+	flag.StringVar(&userSubtitleFile, "sub-file", "", "A .srt or .vtt file with subtitles to show")
 	flag.BoolVar(&showVersion, "v", false, "Output the current version")
 	flag.Parse()
 
@@ -126,10 +184,83 @@ func parseArgs() ([]string, error) {
 		CHARS = CHARS_BLOCK
 	case "filled":
 		CHARS = []rune{'█'}
+	case "half":
+		renderMode = RENDER_HALF_BLOCK
+	case "braille":
+		renderMode = RENDER_BRAILLE
 	default:
 		return nil, taggedErrf("main", "unknown character set \"%s\"", userChars)
 	}
 
+	switch userColors {
+	case "auto":
+		colorDepth = detectColorDepth()
+	case "truecolor":
+		colorDepth = COLOR_DEPTH_TRUECOLOR
+	case "256":
+		colorDepth = COLOR_DEPTH_256
+	case "16":
+		colorDepth = COLOR_DEPTH_16
+	default:
+		return nil, taggedErrf("main", "unknown color depth \"%s\"", userColors)
+	}
+
+	switch userDither {
+	case "none":
+		ditherMode = DITHER_NONE
+	case "ordered":
+		ditherMode = DITHER_ORDERED
+	case "floyd-steinberg":
+		ditherMode = DITHER_FLOYD_STEINBERG
+	case "atkinson":
+		ditherMode = DITHER_ATKINSON
+	default:
+		return nil, taggedErrf("main", "unknown dither mode \"%s\"", userDither)
+	}
+
+	if userSpeed < MIN_SPEED || userSpeed > MAX_SPEED {
+		return nil, taggedErrf("main", "speed has to be between %g and %g", float64(MIN_SPEED), float64(MAX_SPEED))
+	}
+
+	// The speaker is initialized once with the first file's rate,
+	// so every file has to be resampled to a fixed rate
+	if userSampleRate == 0 {
+		return nil, taggedErrf("main", "sample rate has to be greater than 0")
+	}
+
+	switch userSync {
+	case "video":
+		syncMode = SYNC_VIDEO
+	case "audio":
+		syncMode = SYNC_AUDIO
+	default:
+		return nil, taggedErrf("main", "unknown sync mode \"%s\"", userSync)
+	}
+
+	switch userVisualizer {
+	case "spectrum":
+		visualizerMode = VIS_SPECTRUM
+	case "wave":
+		visualizerMode = VIS_WAVE
+	case "vu":
+		visualizerMode = VIS_VU
+	default:
+		return nil, taggedErrf("main", "unknown visualization \"%s\"", userVisualizer)
+	}
+
+	switch userOutput {
+	case "text":
+		outputMode = OUTPUT_TEXT
+	case "sixel":
+		outputMode = OUTPUT_SIXEL
+	case "kitty":
+		outputMode = OUTPUT_KITTY
+	case "iterm":
+		outputMode = OUTPUT_ITERM
+	default:
+		return nil, taggedErrf("main", "unknown output mode \"%s\"", userOutput)
+	}
+
 	return files, nil
 }
 
@@ -170,8 +301,14 @@ func main() {
 		return
 	}
 
-	if userFPS != 0 {
-		// TODO: Implement custom FPS
+	if listStreams {
+		for _, file := range files {
+			if err := ListStreams(file); err != nil {
+				logError(err)
+				return
+			}
+		}
+		return
 	}
 
 	// Initialize terminal data
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Colors of text drawn on top of the video,
+// which has a background so it is readable on any frame
+var (
+	OVERLAY_FG = RGB(255, 255, 255)
+	OVERLAY_BG = RGB(0, 0, 0)
+)
+
+// A line of text drawn on top of the video
+type overlayLine struct {
+	// Column the line starts at
+	x     int
+	cells []Cell
+}
+
+// Splits text into lines of at most `width` characters,
+// breaking at spaces where possible
+func wrapText(text string, width int) []string {
+	var lines []string
+	for _, paragraph := range strings.Split(text, "\n") {
+		line := ""
+		for _, word := range strings.Fields(paragraph) {
+			// Words that are too long on their own are split
+			for utf8.RuneCountInString(word) > width {
+				if line != "" {
+					lines = append(lines, line)
+					line = ""
+				}
+				runes := []rune(word)
+				lines = append(lines, string(runes[:width]))
+				word = string(runes[width:])
+			}
+
+			if line == "" {
+				line = word
+			} else if utf8.RuneCountInString(line)+1+utf8.RuneCountInString(word) <= width {
+				line += " " + word
+			} else {
+				lines = append(lines, line)
+				line = word
+			}
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// Wraps text to `width` columns and centers every line,
+// with one cell of padding on each side
+func layoutOverlayText(text string, width int) []overlayLine {
+	if width < 3 {
+		return nil
+	}
+
+	var layout []overlayLine
+	for _, line := range wrapText(text, width-2) {
+		cells := make([]Cell, 0, utf8.RuneCountInString(line)+2)
+		for _, chr := range " " + line + " " {
+			cells = append(cells, Cell{glyph: chr, fg: OVERLAY_FG, bg: OVERLAY_BG})
+		}
+		layout = append(layout, overlayLine{x: (width - len(cells)) / 2, cells: cells})
+	}
+	return layout
+}
+
+// Where text is drawn on top of the video
+type OverlayPosition int
+
+const (
+	OVERLAY_TOP    OverlayPosition = iota // Messages like the volume
+	OVERLAY_BOTTOM                        // Subtitles
+)
+
+// How long messages are shown
+const OVERLAY_MESSAGE_DURATION = 2 * time.Second
+
+// A short message shown on top of the video, like the current volume
+type OverlayMessage struct {
+	text string
+	// When the message disappears
+	hideTime time.Time
+	// Receives a value whenever a message is shown,
+	// so that the frame can be redrawn while paused
+	changed chan struct{}
+	mu      sync.Mutex
+}
+
+func NewOverlayMessage() *OverlayMessage {
+	return &OverlayMessage{
+		changed: make(chan struct{}, 1),
+	}
+}
+
+// Shows a message for `OVERLAY_MESSAGE_DURATION`, replacing the current one
+func (m *OverlayMessage) Show(text string) {
+	m.mu.Lock()
+	m.text = text
+	m.hideTime = time.Now().Add(OVERLAY_MESSAGE_DURATION)
+	m.mu.Unlock()
+
+	select {
+	case m.changed <- struct{}{}:
+	default:
+		// A redraw is already pending
+	}
+}
+
+// Returns the message that is currently shown, or an empty string
+func (m *OverlayMessage) Text() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if time.Now().After(m.hideTime) {
+		return ""
+	}
+	return m.text
+}
+
+// Returns how long the current message is still shown
+func (m *OverlayMessage) remaining() time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return max(time.Until(m.hideTime), 0)
+}
+
+// Returns a copy of the frame with text drawn centered on its top or bottom rows
+func drawOverlayText(frame *Frame, text string, position OverlayPosition) *Frame {
+	layout := layoutOverlayText(text, frame.width)
+	if len(layout) == 0 {
+		return frame
+	}
+	if len(layout) > frame.height {
+		layout = layout[:frame.height]
+	}
+
+	firstRow := tern(position == OVERLAY_TOP, 0, frame.height-len(layout))
+	result := frame.Clone()
+	for i, line := range layout {
+		copy(result.Row(firstRow + i)[line.x:], line.cells)
+	}
+	return result
+}
+
+// Returns the escape sequences that draw text centered on the top or bottom rows of the terminal,
+// for output modes that don't produce frames of cells
+// @returns the rows that were drawn on, starting at 1
+func overlayTextEscapes(text string, position OverlayPosition) (string, []int) {
+	layout := layoutOverlayText(text, int(termData.cols))
+	if len(layout) > int(termData.rows) {
+		layout = layout[:termData.rows]
+	}
+
+	firstRow := tern(position == OVERLAY_TOP, 1, int(termData.rows)-len(layout)+1)
+	var sb strings.Builder
+	rows := make([]int, 0, len(layout))
+	for i, line := range layout {
+		row := firstRow + i
+		sb.WriteString("\033[" + strconv.Itoa(row) + ";" + strconv.Itoa(line.x+1) + "H")
+		writeCells(&sb, line.cells)
+		rows = append(rows, row)
+	}
+	return sb.String(), rows
+}
+
+// Returns the escape sequences that clear the given rows of the terminal
+func clearRowsEscapes(rows []int) string {
+	var sb strings.Builder
+	for _, row := range rows {
+		sb.WriteString("\033[" + strconv.Itoa(row) + ";1H\033[2K")
+	}
+	return sb.String()
+}
@@ -8,6 +8,7 @@ type PlayerFinishedWaitGroup struct {
 	audioFinished    bool          // Whether audio player has finished
 	videoFinished    bool          // Whether video player has finished
 	completionSignal chan struct{} // Closed when both players finish
+	audioSignal      chan struct{} // Closed when the audio player finishes
 	mu               sync.Mutex    // Guards against concurrent modifications
 }
 
@@ -16,6 +17,7 @@ func NewPlayerFinishedWaitGroup() *PlayerFinishedWaitGroup {
 		audioFinished:    false,
 		videoFinished:    false,
 		completionSignal: make(chan struct{}),
+		audioSignal:      make(chan struct{}),
 	}
 }
 
@@ -24,6 +26,9 @@ func NewPlayerFinishedWaitGroup() *PlayerFinishedWaitGroup {
 func (wg *PlayerFinishedWaitGroup) AudioFinished() {
 	wg.mu.Lock()
 	defer wg.mu.Unlock()
+	if !wg.audioFinished {
+		close(wg.audioSignal)
+	}
 	wg.audioFinished = true
 
 	if wg.audioFinished && wg.videoFinished {
@@ -49,6 +54,11 @@ func (wg *PlayerFinishedWaitGroup) Done() <-chan struct{} {
 	return wg.completionSignal
 }
 
+// AudioDone returns a channel that's closed when the audio player has completed
+func (wg *PlayerFinishedWaitGroup) AudioDone() <-chan struct{} {
+	return wg.audioSignal
+}
+
 // Reset clears the completion status for both players
 // This allows the wait group to be reused
 func (wg *PlayerFinishedWaitGroup) Reset() {
@@ -57,4 +67,5 @@ func (wg *PlayerFinishedWaitGroup) Reset() {
 	wg.audioFinished = false
 	wg.videoFinished = false
 	wg.completionSignal = make(chan struct{})
+	wg.audioSignal = make(chan struct{})
 }
@@ -0,0 +1,146 @@
+// This file contains an encoder for the sixel graphics format,
+// which is supported by terminals like xterm, foot, mlterm and WezTerm.
+// Please see https://vt100.net/docs/vt3xx-gp/chapter14.html
+// for a description of the format.
+
+package main
+
+import (
+	"bytes"
+	"image"
+	"strconv"
+)
+
+// Number of levels per channel of the color cube used as the palette
+const SIXEL_CUBE_LEVELS = 6
+
+// Number of colors in the palette
+const SIXEL_PALETTE_SIZE = SIXEL_CUBE_LEVELS * SIXEL_CUBE_LEVELS * SIXEL_CUBE_LEVELS
+
+// Height of a band of pixels that is encoded as one row of sixels
+const SIXEL_BAND_HEIGHT = 6
+
+// Maps a color channel from 0-255 to a level of the color cube
+func toCubeLevel(v uint32) int {
+	return int((v*(SIXEL_CUBE_LEVELS-1) + 127) / 255)
+}
+
+// Maps a level of the color cube to a percentage, as used by sixel color definitions
+func cubeLevelPercent(level int) string {
+	return strconv.Itoa(level * 100 / (SIXEL_CUBE_LEVELS - 1))
+}
+
+// Quantizes a pixel to the index of the nearest color in the palette
+func toSixelPaletteIndex(r, g, b uint32) int {
+	return toCubeLevel(r)*SIXEL_CUBE_LEVELS*SIXEL_CUBE_LEVELS + toCubeLevel(g)*SIXEL_CUBE_LEVELS + toCubeLevel(b)
+}
+
+// Converts an image to a sixel DCS sequence.
+// The image is quantized to a fixed palette,
+// which is fast and doesn't flicker between frames.
+func imgToSixel(img image.Image) []byte {
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+
+	// Quantize the image
+	indices := make([]uint8, width*height)
+	var used [SIXEL_PALETTE_SIZE]bool
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			r, g, b, _ := normalizeRGBA(img.At(x, y).RGBA())
+			index := toSixelPaletteIndex(r, g, b)
+			indices[y*width+x] = uint8(index)
+			used[index] = true
+		}
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(width * height / 2)
+
+	// Start sixel mode, pixels without a color keep their previous content
+	buf.WriteString("\033P0;1q")
+	// Raster attributes: square pixels and the image size
+	buf.WriteString("\"1;1;" + strconv.Itoa(width) + ";" + strconv.Itoa(height))
+
+	// Define the colors that are used, in percent
+	for index, isUsed := range used {
+		if !isUsed {
+			continue
+		}
+		r := index / (SIXEL_CUBE_LEVELS * SIXEL_CUBE_LEVELS)
+		g := index / SIXEL_CUBE_LEVELS % SIXEL_CUBE_LEVELS
+		b := index % SIXEL_CUBE_LEVELS
+		buf.WriteString("#" + strconv.Itoa(index) + ";2;" + cubeLevelPercent(r) + ";" + cubeLevelPercent(g) + ";" + cubeLevelPercent(b))
+	}
+
+	// Bit masks of the pixels in the current band, per color and column
+	var masks [SIXEL_PALETTE_SIZE][]byte
+	var inBand [SIXEL_PALETTE_SIZE]bool
+	colorsInBand := make([]int, 0, SIXEL_PALETTE_SIZE)
+
+	for bandY := 0; bandY < height; bandY += SIXEL_BAND_HEIGHT {
+		for _, index := range colorsInBand {
+			inBand[index] = false
+		}
+		colorsInBand = colorsInBand[:0]
+
+		for dy := 0; dy < SIXEL_BAND_HEIGHT && bandY+dy < height; dy++ {
+			row := indices[(bandY+dy)*width : (bandY+dy+1)*width]
+			for x, index := range row {
+				if masks[index] == nil {
+					masks[index] = make([]byte, width)
+				}
+				if !inBand[index] {
+					inBand[index] = true
+					colorsInBand = append(colorsInBand, int(index))
+				}
+				masks[index][x] |= 1 << dy
+			}
+		}
+
+		// Every color is drawn on top of the band separately
+		for i, index := range colorsInBand {
+			if i > 0 {
+				// Return to the start of the band
+				buf.WriteByte('$')
+			}
+			buf.WriteString("#" + strconv.Itoa(index))
+			writeSixelRow(&buf, masks[index])
+			clear(masks[index])
+		}
+		if bandY+SIXEL_BAND_HEIGHT < height {
+			// Move to the next band
+			buf.WriteByte('-')
+		}
+	}
+
+	// End sixel mode
+	buf.WriteString("\033\\")
+	return buf.Bytes()
+}
+
+// Writes one row of sixels, using run length encoding for repeated sixels
+func writeSixelRow(buf *bytes.Buffer, mask []byte) {
+	// Empty sixels at the end don't need to be written
+	end := len(mask)
+	for end > 0 && mask[end-1] == 0 {
+		end--
+	}
+
+	for x := 0; x < end; {
+		run := 1
+		for x+run < end && mask[x+run] == mask[x] {
+			run++
+		}
+
+		chr := byte('?' + mask[x])
+		if run > 3 {
+			buf.WriteString("!" + strconv.Itoa(run))
+			buf.WriteByte(chr)
+		} else {
+			for range run {
+				buf.WriteByte(chr)
+			}
+		}
+		x += run
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import "sync/atomic"
+
+// PlaybackStats collects statistics about the playback of a file.
+// The counters can be updated from any goroutine.
+type PlaybackStats struct {
+	shownFrames   atomic.Int64 // Frames that were sent to the video player
+	droppedFrames atomic.Int64 // Frames that were discarded because they were too late
+}
+
+func NewPlaybackStats() *PlaybackStats {
+	return &PlaybackStats{}
+}
+
+// FrameShown counts a frame that was shown
+func (s *PlaybackStats) FrameShown() {
+	s.shownFrames.Add(1)
+}
+
+// FrameDropped counts a frame that was dropped
+// @returns the total number of dropped frames
+func (s *PlaybackStats) FrameDropped() int64 {
+	return s.droppedFrames.Add(1)
+}
+
+// Reset sets all counters back to zero
+func (s *PlaybackStats) Reset() {
+	s.shownFrames.Store(0)
+	s.droppedFrames.Store(0)
+}
+
+// Log writes a summary of the statistics to the log
+func (s *PlaybackStats) Log() {
+	logger.Info("stats", "Shown frames: %d, dropped frames: %d", s.shownFrames.Load(), s.droppedFrames.Load())
+}
@@ -0,0 +1,198 @@
+// This file contains parsers for text subtitles,
+// both from subtitle streams embedded in the file
+// and from .srt and .vtt files next to it.
+
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/asticode/go-astiav"
+)
+
+// How long a subtitle is shown if its packet has no duration
+const DEFAULT_SUBTITLE_DURATION = 4 * time.Second
+
+// Extensions of subtitle files that are loaded automatically
+var SUBTITLE_EXTENSIONS = []string{".srt", ".vtt"}
+
+// A line of subtitles and when it is shown
+type Subtitle struct {
+	start time.Duration
+	end   time.Duration
+	text  string
+}
+
+// The subtitles of a file.
+// Embedded subtitles are added while the file is read,
+// so the track is safe for concurrent use.
+type SubtitleTrack struct {
+	subtitles []Subtitle
+	mu        sync.Mutex
+}
+
+func NewSubtitleTrack() *SubtitleTrack {
+	return &SubtitleTrack{}
+}
+
+// Adds a subtitle to the track.
+// Subtitles are read again after seeking, so duplicates are ignored.
+func (s *SubtitleTrack) Add(sub Subtitle) {
+	if sub.text == "" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if slices.Contains(s.subtitles, sub) {
+		return
+	}
+	s.subtitles = append(s.subtitles, sub)
+}
+
+// Returns the text of all subtitles shown at `pos`, separated by newlines
+func (s *SubtitleTrack) TextAt(pos time.Duration) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var lines []string
+	for _, sub := range s.subtitles {
+		if sub.start <= pos && pos < sub.end {
+			lines = append(lines, sub.text)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Loads the subtitles from a .srt or .vtt file
+func (s *SubtitleTrack) LoadFile(filename string) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return taggedErrf("subtitles", "could not read subtitle file \"%s\": %s", filename, err.Error())
+	}
+	subtitles := parseSubtitleFile(string(data))
+	logger.Info("subtitles", "Loaded %d subtitles from %s", len(subtitles), filename)
+	for _, sub := range subtitles {
+		s.Add(sub)
+	}
+	return nil
+}
+
+// Looks for a subtitle file with the same name as the video file
+// @returns an empty string if there is none
+func findSubtitleFile(videoFile string) string {
+	base := strings.TrimSuffix(videoFile, filepath.Ext(videoFile))
+	for _, ext := range SUBTITLE_EXTENSIONS {
+		if info, err := os.Stat(base + ext); err == nil && !info.IsDir() {
+			return base + ext
+		}
+	}
+	return ""
+}
+
+// Matches the timing line of a cue, like "00:01:02,500 --> 00:01:04,000".
+// WebVTT uses dots instead of commas and may leave out the hours.
+var CUE_TIMING_REGEX = regexp.MustCompile(`^((?:\d+:)?\d+:\d+[.,]\d+)\s*-->\s*((?:\d+:)?\d+:\d+[.,]\d+)`)
+
+// Parses the cues of a SubRip or WebVTT file
+func parseSubtitleFile(data string) []Subtitle {
+	data = strings.ReplaceAll(strings.TrimPrefix(data, "\uFEFF"), "\r\n", "\n")
+
+	var subtitles []Subtitle
+	// Cues are separated by empty lines
+	for _, block := range strings.Split(data, "\n\n") {
+		lines := strings.Split(strings.TrimSpace(block), "\n")
+		for i, line := range lines {
+			match := CUE_TIMING_REGEX.FindStringSubmatch(line)
+			if match == nil {
+				// Cue numbers, identifiers and headers
+				continue
+			}
+			start, err1 := parseCueTimestamp(match[1])
+			end, err2 := parseCueTimestamp(match[2])
+			if err1 != nil || err2 != nil {
+				break
+			}
+			subtitles = append(subtitles, Subtitle{
+				start: start,
+				end:   end,
+				text:  stripMarkup(strings.Join(lines[i+1:], "\n")),
+			})
+			break
+		}
+	}
+	return subtitles
+}
+
+// Parses a timestamp like "01:02:03,456" or "02:03.456"
+func parseCueTimestamp(timestamp string) (time.Duration, error) {
+	parts := strings.Split(strings.ReplaceAll(timestamp, ",", "."), ":")
+	seconds, err := strconv.ParseFloat(parts[len(parts)-1], 64)
+	if err != nil {
+		return 0, err
+	}
+	minutes := 0
+	for _, part := range parts[:len(parts)-1] {
+		value, err := strconv.Atoi(part)
+		if err != nil {
+			return 0, err
+		}
+		minutes = minutes*60 + value
+	}
+	return time.Duration(minutes)*time.Minute + time.Duration(seconds*float64(time.Second)), nil
+}
+
+// Matches HTML-like tags such as <i> and ASS override blocks such as {\an8}
+var SUBTITLE_MARKUP_REGEX = regexp.MustCompile(`<[^>]*>|\{\\[^}]*\}`)
+
+// Removes formatting from subtitle text
+func stripMarkup(text string) string {
+	text = SUBTITLE_MARKUP_REGEX.ReplaceAllString(text, "")
+	// ASS line breaks and hard spaces
+	text = strings.NewReplacer(`\N`, "\n", `\n`, "\n", `\h`, " ").Replace(text)
+	return strings.TrimSpace(text)
+}
+
+// Returns whether subtitles of the codec are text that can be shown
+func isTextSubtitle(codecID astiav.CodecID) bool {
+	switch codecID {
+	case astiav.CodecIDSubrip, astiav.CodecIDSrt, astiav.CodecIDText, astiav.CodecIDWebvtt,
+		astiav.CodecIDAss, astiav.CodecIDSsa, astiav.CodecIDMovText:
+		return true
+	default:
+		return false
+	}
+}
+
+// Number of fields in front of the text of an ASS packet:
+// ReadOrder, Layer, Style, Name, MarginL, MarginR, MarginV, Effect
+const ASS_PACKET_FIELDS = 8
+
+// Extracts the text from the packet of a text subtitle stream.
+// libav's subtitle decoders aren't exposed by go-astiav,
+// but text subtitles are simple enough to parse directly.
+func subtitlePacketText(codecID astiav.CodecID, data []byte) string {
+	switch codecID {
+	case astiav.CodecIDAss, astiav.CodecIDSsa:
+		fields := strings.SplitN(string(data), ",", ASS_PACKET_FIELDS+1)
+		if len(fields) <= ASS_PACKET_FIELDS {
+			return ""
+		}
+		return stripMarkup(fields[ASS_PACKET_FIELDS])
+	case astiav.CodecIDMovText:
+		// The text is prefixed with its length, and followed by styling boxes
+		if len(data) < 2 {
+			return ""
+		}
+		length := int(binary.BigEndian.Uint16(data))
+		return stripMarkup(string(data[2:min(2+length, len(data))]))
+	default:
+		return stripMarkup(string(data))
+	}
+}
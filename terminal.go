@@ -3,10 +3,16 @@ package main
 import (
 	"fmt"
 	"math"
+	"os"
+
+	"golang.org/x/term"
 )
 
 var inAlternateBuffer bool
 
+// The terminal state before entering raw mode, nil if not in raw mode
+var rawModeState *term.State
+
 type TermData struct {
 	pixWidth  uint // Width of terminal in pixels
 	pixHeight uint // Height of terminal in pxels
@@ -42,6 +48,17 @@ func (t *TermData) updateSize() (changed bool, err error) {
 	return changed, nil
 }
 
+// Height of a character in pixels, for terminals that don't report their size in pixels
+const DEFAULT_CELL_HEIGHT = 16
+
+// Returns the size of a character in pixels
+func (t *TermData) cellSize() (width float64, height float64) {
+	if t.pixWidth != 0 && t.pixHeight != 0 {
+		return float64(t.pixWidth) / float64(t.cols), float64(t.pixHeight) / float64(t.rows)
+	}
+	return DEFAULT_CELL_HEIGHT / float64(t.ratio), DEFAULT_CELL_HEIGHT
+}
+
 // Enters a alternate buffer
 func enterAlternateBuffer() {
 	if !inAlternateBuffer {
@@ -58,9 +75,33 @@ func exitAlternateBuffer() {
 	}
 }
 
+// Puts the terminal into raw mode so that single key presses can be read
+func enterRawMode() error {
+	if rawModeState != nil {
+		return nil
+	}
+	state, err := term.MakeRaw(int(os.Stdin.Fd()))
+	if err != nil {
+		return tagErr("terminal", err)
+	}
+	rawModeState = state
+	return nil
+}
+
+// Restores the terminal state from before entering raw mode
+func exitRawMode() {
+	if rawModeState != nil {
+		term.Restore(int(os.Stdin.Fd()), rawModeState)
+		rawModeState = nil
+	}
+}
+
 var CLEAR_SCREEN_TERM []rune = []rune("\033[2J")
 var MOVE_HOME_TERM []rune = []rune("\033[H")
 
+// Raw mode disables output processing, so a carriage return is needed explicitly
+var NEWLINE_TERM []rune = []rune("\r\n")
+
 func hideCursor() {
 	fmt.Print("\033[?25l")
 }
@@ -1,63 +1,319 @@
 package main
 
 import (
+	"sync"
 	"time"
+)
+
+// Frames that are later than this are dropped
+const MAX_FRAME_LATENESS = 50 * time.Millisecond
+
+// Frames are never dropped if no frame was shown for this long,
+// so that the video doesn't freeze when the pipeline is always too slow
+const MAX_FRAME_DROP_DURATION = 500 * time.Millisecond
+
+// Which clock the playback is synchronized to
+type SyncMode int
+
+const (
+	SYNC_VIDEO SyncMode = iota // The timer runs on the system clock, the audio skips ahead or waits to follow it
+	SYNC_AUDIO                 // The timer follows the audio that has been played, the video drops frames to follow it
+)
+
+var syncMode SyncMode
 
-	"github.com/asticode/go-astiav"
+// Range of the playback speed and how much the speed keys change it
+const (
+	MIN_SPEED  = 0.25
+	MAX_SPEED  = 4
+	SPEED_STEP = 0.25
 )
 
+// Timer shows every frame at its presentation timestamp.
+// It also provides the playback clock that the audio player synchronizes to.
 type Timer struct {
 	input     chan *Image
 	output    chan *Image
-	waitTime  time.Duration
-	endTime   time.Time
 	isPlaying bool
+	// The point in time at which the start of the file was (or would have been) shown
+	// if it had always been played at the current speed
 	startTime time.Time
-	pctx      *PlayerContext
+	// How many times faster than normal the clock runs, kept between files
+	speed float64
+	// Whether the playback is currently paused
+	isPaused bool
+	// When the current pause started
+	pauseTime time.Time
+	// Closed and replaced whenever the clock is paused, resumed or moved,
+	// so that waiting goroutines can recalculate their deadlines
+	clockChanged chan struct{}
+	// When the last frame was shown
+	lastFrameTime time.Time
+	// Increased with every seek, so that frames from before the seek can be discarded
+	generation uint64
+	// Whether a discarded image needed the screen to be cleared,
+	// which is then done before the next image that is shown
+	pendingClear bool
+	// Guards the clock, which is also read by the audio player
+	mu   sync.Mutex
+	pctx *PlayerContext
 }
 
 // Reset sets up the input and output channels using parameters.
 func (t *Timer) Reset(input chan *Image, output chan *Image) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
 	t.input = input
 	t.output = output
 	t.isPlaying = false
+	t.isPaused = false
+	t.generation = 0
+	t.pendingClear = false
+	t.clockChanged = make(chan struct{})
 }
 
 func NewTimer(pctx *PlayerContext) *Timer {
 	return &Timer{
-		endTime: time.Now(),
-		pctx:    pctx,
+		clockChanged: make(chan struct{}),
+		speed:        userSpeed,
+		pctx:         pctx,
 	}
 	// Output and input channels set in Reset
 }
 
-func (t *Timer) wait() {
+// Position returns how much time of the video has been played,
+// not counting the time spent paused.
+// It advances faster or slower than real time if the speed was changed.
+func (t *Timer) Position() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.position()
+}
+
+// Same as Position, but the caller has to hold the lock
+func (t *Timer) position() time.Duration {
 	if !t.isPlaying {
-		t.endTime = time.Now()
-		t.startTime = t.endTime
-		t.isPlaying = true
+		return 0
 	}
+	if t.isPaused {
+		return t.scale(t.pauseTime.Sub(t.startTime))
+	}
+	return t.scale(time.Since(t.startTime))
+}
 
-	t.endTime = t.endTime.Add(t.waitTime)
+// Converts real time to playback time at the current speed.
+// The caller has to hold the lock.
+func (t *Timer) scale(d time.Duration) time.Duration {
+	return time.Duration(float64(d) * t.speed)
+}
 
-	timeLeft := time.Until(t.endTime)
+// Converts playback time at the current speed to real time.
+// The caller has to hold the lock.
+func (t *Timer) unscale(d time.Duration) time.Duration {
+	return time.Duration(float64(d) / t.speed)
+}
 
-	if timeLeft > 0 {
-		time.Sleep(timeLeft)
+// IsPaused returns whether the playback is currently paused
+func (t *Timer) IsPaused() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.isPaused
+}
+
+// Notifies waiting goroutines that the clock changed.
+// The caller has to hold the lock.
+func (t *Timer) notifyClockChanged() {
+	close(t.clockChanged)
+	t.clockChanged = make(chan struct{})
+}
+
+// Speed returns how many times faster than normal the video is played
+func (t *Timer) Speed() float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.speed
+}
+
+// ChangeSpeed changes the speed by `delta`, keeping the current position
+// @returns the new speed
+func (t *Timer) ChangeSpeed(delta float64) float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	pos := t.position()
+	t.speed = min(max(t.speed+delta, MIN_SPEED), MAX_SPEED)
+
+	// Move the start so that the position stays the same at the new speed
+	now := time.Now()
+	if t.isPaused {
+		now = t.pauseTime
+	}
+	t.startTime = now.Add(-t.unscale(pos))
+	logger.Info("timer", "Changed speed to %gx", t.speed)
+
+	t.notifyClockChanged()
+	return t.speed
+}
+
+// TogglePause pauses the clock if it is running and resumes it otherwise
+func (t *Timer) TogglePause() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.isPaused {
+		// Shift the clock by the time spent paused,
+		// so that the paused interval is skipped
+		pausedFor := time.Since(t.pauseTime)
+		t.startTime = t.startTime.Add(pausedFor)
+		t.isPaused = false
+		logger.Info("timer", "Resumed after %s", pausedFor)
 	} else {
-		logger.Info("timer", "Frame took too long to render")
+		t.pauseTime = time.Now()
+		t.isPaused = true
+		logger.Info("timer", "Paused")
 	}
+
+	t.notifyClockChanged()
 }
 
-func (t *Timer) Start(fps astiav.Rational) error {
-	num := float64(fps.Num())
-	den := float64(fps.Den())
-	t.waitTime = time.Duration((den * 1e9 / num))
+// Generation returns the seek generation, which frames are stamped with when they are sent
+func (t *Timer) Generation() uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.generation
+}
 
-	for {
-		// Wait for timing
-		t.wait()
+// IsStale returns whether a frame of seek generation `generation` was sent before the last seek
+func (t *Timer) IsStale(generation uint64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return generation != t.generation
+}
+
+// Seek moves the clock to `pos`.
+// Frames that are still on their way belong to the old position and are discarded.
+// @returns the new seek generation
+func (t *Timer) Seek(pos time.Duration) uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	if t.isPaused {
+		now = t.pauseTime
+	}
+	t.startTime = now.Add(-t.unscale(pos))
+	t.isPlaying = true
+	t.lastFrameTime = time.Now()
+	t.generation++
+
+	t.notifyClockChanged()
+	return t.generation
+}
+
+// SyncTo moves the clock to `pos`, the position of the audio that is currently heard,
+// when the audio is the master clock.
+// Differences up to `tolerance` are ignored, so that the clock doesn't jitter.
+// If the clock isn't running yet, it is started, so that the video starts with the audio.
+func (t *Timer) SyncTo(pos time.Duration, tolerance time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
 
+	if t.isPaused {
+		return
+	}
+	if !t.isPlaying {
+		t.startTime = time.Now().Add(-t.unscale(pos))
+		t.isPlaying = true
+		t.lastFrameTime = time.Now()
+		t.notifyClockChanged()
+		return
+	}
+
+	drift := pos - t.position()
+	if drift <= tolerance && drift >= -tolerance {
+		return
+	}
+	t.startTime = t.startTime.Add(-t.unscale(drift))
+	logger.Info("timer", "Moved clock by %s to follow the audio", drift)
+	t.notifyClockChanged()
+}
+
+// ShouldDrop returns whether a frame with `pts` is too late to be shown.
+// Every dropped frame has to be reported with this function,
+// as the frame is counted as dropped if true is returned.
+func (t *Timer) ShouldDrop(pts time.Duration) bool {
+	if !frameDropEnabled {
+		return false
+	}
+
+	t.mu.Lock()
+	if !t.isPlaying || t.isPaused {
+		t.mu.Unlock()
+		return false
+	}
+	lateness := t.position() - pts
+	drop := lateness > MAX_FRAME_LATENESS && time.Since(t.lastFrameTime) < MAX_FRAME_DROP_DURATION
+	t.mu.Unlock()
+
+	if drop {
+		dropped := t.pctx.stats.FrameDropped()
+		logger.Info("timer", "Dropped frame that was late by %s, %d frames dropped in total", lateness, dropped)
+	}
+	return drop
+}
+
+// Waits until the clock reaches `pts`.
+// If the clock isn't running yet, it is started at `pts`.
+// @returns false if the context was cancelled while waiting
+// or if the clock was moved by a seek, after which the frame of `generation` is not shown
+func (t *Timer) waitUntil(pts time.Duration, generation uint64) bool {
+	for waited := false; ; waited = true {
+		t.mu.Lock()
+		if t.generation != generation {
+			t.mu.Unlock()
+			return false
+		}
+		if !t.isPlaying {
+			t.startTime = time.Now().Add(-t.unscale(pts))
+			t.isPlaying = true
+			t.lastFrameTime = time.Now()
+		}
+		isPaused := t.isPaused
+		clockChanged := t.clockChanged
+		timeLeft := pts - t.position()
+		realTimeLeft := t.unscale(timeLeft)
+		t.mu.Unlock()
+
+		if !isPaused && timeLeft <= 0 {
+			if !waited && timeLeft < 0 {
+				logger.Info("timer", "Frame took too long to render, late by %s", -timeLeft)
+			}
+			return true
+		}
+
+		// Sleep until the deadline or until the clock was changed
+		var deadline <-chan time.Time
+		if !isPaused {
+			deadline = time.After(realTimeLeft)
+		}
+		select {
+		case <-t.pctx.ctx.Done():
+			return false
+		case <-clockChanged:
+		case <-deadline:
+		}
+	}
+}
+
+// Discards an image that won't be shown.
+// The screen size is only reported as changed once,
+// so the clear that the image needed is kept for the next one.
+func (t *Timer) discard(img *Image) {
+	t.pendingClear = t.pendingClear || img.needsClear
+}
+
+func (t *Timer) Start() error {
+	for {
 		// Receive from input with context checking
 		select {
 		case <-t.pctx.ctx.Done():
@@ -70,6 +326,26 @@ func (t *Timer) Start(fps astiav.Rational) error {
 				return nil
 			}
 
+			if t.IsStale(data.generation) || t.ShouldDrop(data.pts) {
+				t.discard(data)
+				continue
+			}
+
+			// Wait for timing
+			if !t.waitUntil(data.pts, data.generation) {
+				if t.pctx.ctx.Err() != nil {
+					logger.Info("timer", "Stopped")
+					return nil
+				}
+				// A seek happened while waiting
+				t.discard(data)
+				continue
+			}
+			if t.pendingClear {
+				data.needsClear = true
+				t.pendingClear = false
+			}
+
 			// Send to output with context checking
 			select {
 			case <-t.pctx.ctx.Done():
@@ -77,6 +353,10 @@ func (t *Timer) Start(fps astiav.Rational) error {
 				return nil
 			case t.output <- data:
 				// Successfully sent data
+				t.mu.Lock()
+				t.lastFrameTime = time.Now()
+				t.mu.Unlock()
+				t.pctx.stats.FrameShown()
 			}
 		}
 	}
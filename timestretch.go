@@ -0,0 +1,134 @@
+// This file contains a time-stretcher that changes the speed of audio without changing its pitch.
+// It uses WSOLA (waveform similarity overlap-add): the audio is cut into segments
+// that are taken from the input further apart or closer together than they are output,
+// and every segment is moved slightly so that it lines up with the previous one before they are crossfaded.
+
+package main
+
+import "math"
+
+// Length of the segments and of the crossfade between them
+const STRETCH_SEGMENT_MILLISECONDS = 20
+
+// How far a segment may be moved to line up with the previous one
+const STRETCH_SEEK_MILLISECONDS = 8
+
+// Only every nth sample is compared when lining up segments, which is accurate enough and much faster
+const STRETCH_CORRELATION_STRIDE = 4
+
+type timeStretcher struct {
+	segmentSize int
+	seekSize    int
+	// Input samples that are still needed
+	input AudioFrame
+	// Where the next segment starts in `input` before it is lined up.
+	// It is fractional, so that rounding doesn't change the speed.
+	nominalPos float64
+	// The input that followed the last segment, which the next segment is crossfaded with
+	tail AudioFrame
+	// Output samples that didn't fit into the last buffer
+	output AudioFrame
+}
+
+func newTimeStretcher(sampleRate int) *timeStretcher {
+	return &timeStretcher{
+		segmentSize: sampleRate * STRETCH_SEGMENT_MILLISECONDS / 1000,
+		seekSize:    sampleRate * STRETCH_SEEK_MILLISECONDS / 1000,
+	}
+}
+
+// Discards all buffered audio, like after seeking
+func (s *timeStretcher) reset() {
+	s.input = s.input[:0]
+	s.nominalPos = 0
+	s.tail = nil
+	s.output = nil
+}
+
+// Returns the number of input samples that were read but not played yet
+func (s *timeStretcher) buffered() int {
+	return len(s.input) - int(s.nominalPos)
+}
+
+// Fills `samples` with audio from `source`, played `speed` times as fast
+// @returns the number of samples filled and whether more samples are available
+func (s *timeStretcher) stretch(samples AudioFrame, speed float64, source func(AudioFrame) (int, bool)) (n int, ok bool) {
+	n = copy(samples, s.output)
+	s.output = s.output[n:]
+
+	for n < len(samples) {
+		if !s.fill(source) {
+			return n, n > 0
+		}
+		segment := s.nextSegment(speed)
+		copied := copy(samples[n:], segment)
+		s.output = segment[copied:]
+		n += copied
+	}
+	return n, true
+}
+
+// Reads from `source` until the input holds every sample the next segment may be taken from
+// @returns whether enough samples are available
+func (s *timeStretcher) fill(source func(AudioFrame) (int, bool)) bool {
+	needed := int(s.nominalPos) + s.seekSize + 2*s.segmentSize
+	for len(s.input) < needed {
+		buf := make(AudioFrame, needed-len(s.input))
+		n, ok := source(buf)
+		s.input = append(s.input, buf[:n]...)
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Takes the next segment from the input and crossfades it with the previous one.
+// The input that is no longer needed is dropped.
+func (s *timeStretcher) nextSegment(speed float64) AudioFrame {
+	nominal := int(s.nominalPos)
+	start := nominal
+	if s.tail != nil {
+		start = s.bestMatch(nominal)
+	}
+
+	segment := make(AudioFrame, s.segmentSize)
+	copy(segment, s.input[start:start+s.segmentSize])
+	if s.tail != nil {
+		for i := range segment {
+			fade := float64(i) / float64(s.segmentSize)
+			segment[i][0] = s.tail[i][0]*(1-fade) + segment[i][0]*fade
+			segment[i][1] = s.tail[i][1]*(1-fade) + segment[i][1]*fade
+		}
+	}
+	s.tail = append(s.tail[:0], s.input[start+s.segmentSize:start+2*s.segmentSize]...)
+
+	// Segments are taken `speed` times further apart than they are output
+	s.nominalPos += float64(s.segmentSize) * speed
+	drop := max(int(s.nominalPos)-s.seekSize, 0)
+	s.input = s.input[:copy(s.input, s.input[drop:])]
+	s.nominalPos -= float64(drop)
+
+	return segment
+}
+
+// Finds the start of the segment near `nominal` that is most similar to the tail,
+// so that the crossfade doesn't cancel out parts of the waveform
+func (s *timeStretcher) bestMatch(nominal int) int {
+	best := nominal
+	bestScore := math.Inf(-1)
+	for candidate := max(nominal-s.seekSize, 0); candidate <= nominal+s.seekSize; candidate++ {
+		// Normalized cross-correlation of the mono signals
+		var correlation, energy float64
+		for i := 0; i < s.segmentSize; i += STRETCH_CORRELATION_STRIDE {
+			in := s.input[candidate+i][0] + s.input[candidate+i][1]
+			correlation += (s.tail[i][0] + s.tail[i][1]) * in
+			energy += in * in
+		}
+		score := correlation / math.Sqrt(energy+1e-9)
+		if score > bestScore {
+			best, bestScore = candidate, score
+		}
+	}
+	return best
+}
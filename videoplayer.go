@@ -2,25 +2,47 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"os"
+	"strings"
 	"time"
 )
 
 type Image struct {
-	data       []rune
+	frame *Frame
+	// Escape sequences of graphics protocols, written instead of `frame`
+	raw        []byte
 	needsClear bool
+	// When the image should be shown, relative to the start of the file
+	pts time.Duration
+	// The seek generation of the frame it was converted from
+	generation uint64
 }
 
 type VideoPlayer struct {
 	input  chan *Image
 	pctx   *PlayerContext
 	writer *bufio.Writer
+	// The frame currently shown in the terminal, nil if unknown
+	shownFrame *Frame
+	// The graphics output currently shown in the terminal, nil if unknown
+	shownRaw []byte
+	// Text drawn on top of graphics output, and the rows it was drawn on
+	shownOverlayText string
+	shownOverlayRows []int
+	// The last image that was rendered, which is redrawn when a message is shown
+	lastImage *Image
 }
 
 // Reset sets up the input channel using the provided parameter.
 func (v *VideoPlayer) Reset(input chan *Image) {
 	v.input = input
+	v.shownFrame = nil
+	v.shownRaw = nil
+	v.shownOverlayText = ""
+	v.shownOverlayRows = nil
+	v.lastImage = nil
 }
 
 func NewVideoPlayer(pctx *PlayerContext) *VideoPlayer {
@@ -31,15 +53,64 @@ func NewVideoPlayer(pctx *PlayerContext) *VideoPlayer {
 }
 
 func (v *VideoPlayer) renderData(img *Image) {
-	if img.needsClear {
-		v.writer.WriteString(string(CLEAR_SCREEN_TERM))
+	// The caption is shown below the subtitles
+	subtitleText := strings.Trim(v.pctx.subtitles.TextAt(img.pts)+"\n"+v.pctx.caption, "\n")
+	messageText := v.pctx.message.Text()
+
+	if img.raw != nil {
+		overlayText := subtitleText + "\x00" + messageText
+		// Still images are sent repeatedly, but writing the same graphics again only costs bandwidth
+		if !img.needsClear && overlayText == v.shownOverlayText && bytes.Equal(img.raw, v.shownRaw) {
+			return
+		}
+		if img.needsClear {
+			v.writer.WriteString(string(CLEAR_SCREEN_TERM))
+		} else if overlayText != v.shownOverlayText {
+			v.writer.WriteString(clearRowsEscapes(v.shownOverlayRows))
+		}
+		v.writer.WriteString(string(MOVE_HOME_TERM))
+		v.writer.Write(img.raw)
+
+		// The text is drawn on the terminal rows below or on top of the image
+		subtitleEscapes, subtitleRows := overlayTextEscapes(subtitleText, OVERLAY_BOTTOM)
+		messageEscapes, messageRows := overlayTextEscapes(messageText, OVERLAY_TOP)
+		v.writer.WriteString(subtitleEscapes + messageEscapes)
+		v.writer.Flush()
+		v.shownFrame = nil
+		v.shownRaw = img.raw
+		v.shownOverlayText, v.shownOverlayRows = overlayText, append(subtitleRows, messageRows...)
+		return
 	}
 
-	v.writer.WriteString(string(MOVE_HOME_TERM))
+	frame := drawOverlayText(img.frame, subtitleText, OVERLAY_BOTTOM)
+	frame = drawOverlayText(frame, messageText, OVERLAY_TOP)
 
-	v.writer.WriteString(string(img.data))
-	v.writer.Flush()
+	// Only redraw the cells that changed since the last frame
+	if !img.needsClear && v.shownFrame != nil && v.shownFrame.sameSize(frame) {
+		changed, total := frame.changedCells(v.shownFrame), len(frame.cells)
+		if float64(changed) <= DIFF_FULL_REDRAW_RATIO*float64(total) {
+			diff := frame.SerializeDiff(v.shownFrame)
+			v.writer.WriteString(diff)
+			v.writer.Flush()
+			v.shownFrame = frame
+			if logger.Enabled(DEBUG) {
+				// The whole frame is only serialized for the statistic
+				fullSize := len(MOVE_HOME_TERM) + len(frame.Serialize())
+				logger.Debug("videoPlayer", "Redrew %d of %d cells with %d bytes, saved %d bytes", changed, total, len(diff), fullSize-len(diff))
+			}
+			return
+		}
+	}
 
+	fullData := string(MOVE_HOME_TERM) + frame.Serialize()
+	if img.needsClear {
+		v.writer.WriteString(string(CLEAR_SCREEN_TERM))
+	}
+	v.writer.WriteString(fullData)
+	v.writer.Flush()
+	v.shownFrame = frame
+	v.shownRaw = nil
+	logger.Debug("videoPlayer", "Redrew the whole frame with %d bytes", len(fullData))
 }
 
 func (v *VideoPlayer) Start() error {
@@ -49,9 +120,16 @@ func (v *VideoPlayer) Start() error {
 	fmt.Print(string(CLEAR_SCREEN_TERM))
 	hideCursor()
 	defer showCursor()
+	if outputMode == OUTPUT_KITTY {
+		// Images are not part of the text, so they have to be deleted explicitly
+		defer fmt.Print(kittyDeleteImage())
+	}
 
 	logger.Info("videoPlayer", "Started")
 
+	// Fires when the current message has to be hidden
+	var hideMessage <-chan time.Time
+
 	for {
 		select {
 		case <-v.pctx.ctx.Done():
@@ -65,7 +143,25 @@ func (v *VideoPlayer) Start() error {
 			}
 			start := time.Now()
 			v.renderData(data)
+			v.lastImage = data
 			logger.Info("videoPlayer", "Frame took %v to render", time.Since(start))
+		case <-v.pctx.message.changed:
+			// Show the message even if no new frames arrive, like when paused
+			v.redraw()
+			hideMessage = time.After(v.pctx.message.remaining())
+		case <-hideMessage:
+			hideMessage = nil
+			v.redraw()
 		}
 	}
 }
+
+// Renders the last image again, to update the text on top of it
+func (v *VideoPlayer) redraw() {
+	if v.lastImage == nil {
+		return
+	}
+	img := *v.lastImage
+	img.needsClear = false
+	v.renderData(&img)
+}
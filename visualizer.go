@@ -0,0 +1,372 @@
+// This file contains the visualizer, which replaces the video of files that only have audio.
+// It draws the samples that are currently played as images,
+// which are converted and shown like the frames of a video.
+
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"math/cmplx"
+	"sync"
+	"time"
+
+	"github.com/gopxl/beep"
+)
+
+// What the visualizer shows
+type VisualizerMode int
+
+const (
+	VIS_SPECTRUM VisualizerMode = iota // Bars for the loudness of each frequency range
+	VIS_WAVE                           // The waveform, like an oscilloscope
+	VIS_VU                             // Meters for the loudness of each channel
+)
+
+var visualizerMode VisualizerMode
+
+// Frame rate and size of the generated images
+const (
+	VISUALIZER_FPS    = 30
+	VISUALIZER_WIDTH  = 320
+	VISUALIZER_HEIGHT = 180
+)
+
+// Frame rate of cover art, which doesn't change but is sent again
+// so that it is resized with the terminal and the text on top of it is updated
+const COVER_ART_FPS = 2
+
+// Space below the cover art for the title and artist, as a share of the height of the cover art
+const COVER_ART_CAPTION_SPACE = 0.12
+
+// Number of samples the visualization is calculated from, a power of two for the FFT
+const VISUALIZER_WINDOW = 2048
+
+// Number of played samples that are kept for the visualizer
+const SAMPLE_HISTORY_SIZE = 4 * VISUALIZER_WINDOW
+
+// Number of bars of the spectrum and the frequencies they cover
+const (
+	SPECTRUM_BARS          = 32
+	SPECTRUM_MIN_FREQUENCY = 40
+	SPECTRUM_MAX_FREQUENCY = 16000
+)
+
+// Loudness that is shown as empty, in decibels below full scale
+const VISUALIZER_MIN_DB = -60
+
+// How much bars and peaks fall per frame, as a share of the full height,
+// so that they don't flicker
+const VISUALIZER_FALL_RATE = 0.04
+
+var VISUALIZER_BG = color.RGBA{0, 0, 0, 255}
+var VISUALIZER_WAVE_COLOR = color.RGBA{0, 220, 255, 255}
+var VISUALIZER_PEAK_COLOR = color.RGBA{255, 255, 255, 255}
+
+// The samples that were played most recently.
+// They are written by the speaker goroutine and read by the visualizer.
+type SampleHistory struct {
+	// Ring buffer of the samples
+	samples AudioFrame
+	// Index the next sample is written to
+	next int
+	mu   sync.Mutex
+}
+
+func NewSampleHistory() *SampleHistory {
+	return &SampleHistory{
+		samples: make(AudioFrame, SAMPLE_HISTORY_SIZE),
+	}
+}
+
+// Adds samples that are being played
+func (h *SampleHistory) Write(samples AudioFrame) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(samples) > len(h.samples) {
+		samples = samples[len(samples)-len(h.samples):]
+	}
+	for _, sample := range samples {
+		h.samples[h.next] = sample
+		h.next = (h.next + 1) % len(h.samples)
+	}
+}
+
+// Returns `count` samples, ending `skip` samples before the last written one.
+// Skipping samples accounts for the samples that are still waiting in the speaker buffer.
+func (h *SampleHistory) Recent(count int, skip int) AudioFrame {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	skip = min(skip, len(h.samples)-count)
+	start := h.next - skip - count + 2*len(h.samples)
+	recent := make(AudioFrame, count)
+	for i := range recent {
+		recent[i] = h.samples[(start+i)%len(h.samples)]
+	}
+	return recent
+}
+
+// Visualizer generates the frames for files without video
+type Visualizer struct {
+	output chan *VideoFrame
+	// Provides the position the frames are shown at
+	timer *Timer
+	// The current height of the bars, between 0 and 1
+	levels []float64
+	// The highest recent level of each channel of the VU meters
+	peaks [2]float64
+	// The cover art of the file, which is shown instead of the visualization.
+	// It is set by the loader once it is decoded.
+	coverArt   image.Image
+	coverArtMu sync.Mutex
+	pctx       *PlayerContext
+}
+
+// Reset sets up the output channel and timer reference
+func (v *Visualizer) Reset(output chan *VideoFrame, timer *Timer) {
+	v.output = output
+	v.timer = timer
+	v.levels = make([]float64, SPECTRUM_BARS)
+	v.peaks = [2]float64{}
+	v.coverArtMu.Lock()
+	v.coverArt = nil
+	v.coverArtMu.Unlock()
+}
+
+// Shows `img` instead of the visualization.
+// Space for the title and artist is added below it.
+func (v *Visualizer) SetCoverArt(img image.Image) {
+	bounds := img.Bounds()
+	padded := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()+int(float64(bounds.Dy())*COVER_ART_CAPTION_SPACE)))
+	fillRect(padded, padded.Rect, VISUALIZER_BG)
+	draw.Draw(padded, image.Rect(0, 0, bounds.Dx(), bounds.Dy()), img, bounds.Min, draw.Src)
+
+	v.coverArtMu.Lock()
+	defer v.coverArtMu.Unlock()
+	v.coverArt = padded
+}
+
+// Returns the cover art, or nil if there is none
+func (v *Visualizer) currentCoverArt() image.Image {
+	v.coverArtMu.Lock()
+	defer v.coverArtMu.Unlock()
+	return v.coverArt
+}
+
+func NewVisualizer(pctx *PlayerContext) *Visualizer {
+	return &Visualizer{
+		pctx: pctx,
+	}
+	// Output channel set in Reset
+}
+
+// Draws the played samples `VISUALIZER_FPS` times per second until the audio finished.
+// Once there is cover art, it is sent `COVER_ART_FPS` times per second instead.
+func (v *Visualizer) Start(sampleRate int) error {
+	logger.Info("visualizer", "Started")
+
+	// The samples that were just played are still in the speaker buffer
+	latency := beep.SampleRate(sampleRate).N(SPEAKER_BUFFER_MILLISECONDS * time.Millisecond)
+	ticker := time.NewTicker(time.Second / VISUALIZER_FPS)
+	defer ticker.Stop()
+	showsCoverArt := false
+
+	for {
+		select {
+		case <-v.pctx.ctx.Done():
+			logger.Info("visualizer", "Stopped")
+			return nil
+		case <-v.pctx.playerWG.AudioDone():
+			close(v.output)
+			logger.Info("visualizer", "Audio finished")
+			return nil
+		case <-ticker.C:
+			if v.timer.IsPaused() {
+				continue
+			}
+			var img image.Image
+			if coverArt := v.currentCoverArt(); coverArt != nil {
+				if !showsCoverArt {
+					ticker.Reset(time.Second / COVER_ART_FPS)
+					showsCoverArt = true
+				}
+				// The same image is sent every time, so the converter can reuse the result
+				img = coverArt
+			} else {
+				samples := v.pctx.playedSamples.Recent(VISUALIZER_WINDOW, latency)
+				img = v.draw(samples, sampleRate)
+			}
+			frame := &VideoFrame{img: img, pts: v.timer.Position(), generation: v.timer.Generation()}
+
+			select {
+			case <-v.pctx.ctx.Done():
+				logger.Info("visualizer", "Stopped")
+				return nil
+			case v.output <- frame:
+			}
+		}
+	}
+}
+
+// Draws the samples with the current visualizer mode
+func (v *Visualizer) draw(samples AudioFrame, sampleRate int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, VISUALIZER_WIDTH, VISUALIZER_HEIGHT))
+	fillRect(img, img.Rect, VISUALIZER_BG)
+
+	switch visualizerMode {
+	case VIS_WAVE:
+		drawWave(img, samples)
+	case VIS_VU:
+		v.drawVU(img, samples)
+	default:
+		v.drawSpectrum(img, samples, sampleRate)
+	}
+	return img
+}
+
+// Draws a bar for the loudness of each frequency range.
+// The ranges get wider with the frequency, like the pitch that is heard.
+func (v *Visualizer) drawSpectrum(img *image.RGBA, samples AudioFrame, sampleRate int) {
+	// Hann window, so that the edges of the window don't show up as frequencies
+	values := make([]complex128, len(samples))
+	for i, sample := range samples {
+		window := 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(len(samples)-1))
+		values[i] = complex((sample[0]+sample[1])/2*window, 0)
+	}
+	fft(values)
+
+	maxFrequency := min(SPECTRUM_MAX_FREQUENCY, float64(sampleRate)/2)
+	binWidth := float64(sampleRate) / float64(len(values))
+	barWidth := VISUALIZER_WIDTH / SPECTRUM_BARS
+	for bar := range SPECTRUM_BARS {
+		low := SPECTRUM_MIN_FREQUENCY * math.Pow(maxFrequency/SPECTRUM_MIN_FREQUENCY, float64(bar)/SPECTRUM_BARS)
+		high := SPECTRUM_MIN_FREQUENCY * math.Pow(maxFrequency/SPECTRUM_MIN_FREQUENCY, float64(bar+1)/SPECTRUM_BARS)
+		firstBin := int(low / binWidth)
+		lastBin := max(int(high/binWidth), firstBin)
+
+		magnitude := 0.0
+		for bin := firstBin; bin <= lastBin && bin < len(values)/2; bin++ {
+			magnitude = max(magnitude, cmplx.Abs(values[bin]))
+		}
+		// A full scale sine wave has a magnitude of a quarter of the window with the Hann window
+		level := decibelLevel(magnitude / (float64(len(values)) / 4))
+		v.levels[bar] = max(level, v.levels[bar]-VISUALIZER_FALL_RATE)
+
+		height := int(v.levels[bar] * VISUALIZER_HEIGHT)
+		for y := VISUALIZER_HEIGHT - height; y < VISUALIZER_HEIGHT; y++ {
+			c := levelColor(1 - float64(y)/VISUALIZER_HEIGHT)
+			// Leave a gap between the bars
+			for x := bar * barWidth; x < (bar+1)*barWidth-max(barWidth/4, 1); x++ {
+				img.SetRGBA(x, y, c)
+			}
+		}
+	}
+}
+
+// Draws the waveform of both channels mixed together
+func drawWave(img *image.RGBA, samples AudioFrame) {
+	center := VISUALIZER_HEIGHT / 2
+	sampleY := func(x int) int {
+		sample := samples[x*len(samples)/VISUALIZER_WIDTH]
+		y := center - int((sample[0]+sample[1])/2*float64(center))
+		return min(max(y, 0), VISUALIZER_HEIGHT-1)
+	}
+
+	prevY := sampleY(0)
+	for x := range VISUALIZER_WIDTH {
+		// Connect the points with vertical lines, so that steep parts aren't left out
+		y := sampleY(x)
+		for lineY := min(y, prevY); lineY <= max(y, prevY); lineY++ {
+			img.SetRGBA(x, lineY, VISUALIZER_WAVE_COLOR)
+		}
+		prevY = y
+	}
+}
+
+// Draws a horizontal meter for the loudness of each channel,
+// with a marker at the recent peak
+func (v *Visualizer) drawVU(img *image.RGBA, samples AudioFrame) {
+	meterHeight := VISUALIZER_HEIGHT / 4
+	for channel := range 2 {
+		sum := 0.0
+		for _, sample := range samples {
+			sum += sample[channel] * sample[channel]
+		}
+		// The RMS of a full scale sine wave is 1/√2
+		level := decibelLevel(math.Sqrt(sum/float64(len(samples))) * math.Sqrt2)
+		v.peaks[channel] = max(level, v.peaks[channel]-VISUALIZER_FALL_RATE/4)
+
+		top := meterHeight/2 + channel*(meterHeight*2)
+		width := int(level * VISUALIZER_WIDTH)
+		for x := range width {
+			fillRect(img, image.Rect(x, top, x+1, top+meterHeight), levelColor(float64(x)/VISUALIZER_WIDTH))
+		}
+		peakX := min(int(v.peaks[channel]*VISUALIZER_WIDTH), VISUALIZER_WIDTH-2)
+		fillRect(img, image.Rect(peakX, top, peakX+2, top+meterHeight), VISUALIZER_PEAK_COLOR)
+	}
+}
+
+// Maps an amplitude, where 1 is full scale, to a level between 0 and 1 on a decibel scale
+func decibelLevel(amplitude float64) float64 {
+	if amplitude <= 0 {
+		return 0
+	}
+	db := 20 * math.Log10(amplitude)
+	return min(max(1-db/VISUALIZER_MIN_DB, 0), 1)
+}
+
+// Returns the color of a meter at `level`, going from green over yellow to red
+func levelColor(level float64) color.RGBA {
+	switch {
+	case level < 0.6:
+		return color.RGBA{0, 200, 0, 255}
+	case level < 0.85:
+		return color.RGBA{230, 200, 0, 255}
+	default:
+		return color.RGBA{230, 0, 0, 255}
+	}
+}
+
+func fillRect(img *image.RGBA, rect image.Rectangle, c color.RGBA) {
+	rect = rect.Intersect(img.Rect)
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			img.SetRGBA(x, y, c)
+		}
+	}
+}
+
+// Computes the discrete Fourier transform of `values` in place,
+// with the iterative radix-2 Cooley-Tukey algorithm.
+// The length has to be a power of two.
+func fft(values []complex128) {
+	n := len(values)
+
+	// Reorder the values by the bit-reversed index
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+		if i < j {
+			values[i], values[j] = values[j], values[i]
+		}
+	}
+
+	// Combine the transforms of the halves, doubling the size every pass
+	for size := 2; size <= n; size <<= 1 {
+		step := cmplx.Exp(complex(0, -2*math.Pi/float64(size)))
+		for start := 0; start < n; start += size {
+			w := complex(1, 0)
+			for k := range size / 2 {
+				even, odd := values[start+k], values[start+k+size/2]*w
+				values[start+k] = even + odd
+				values[start+k+size/2] = even - odd
+				w *= step
+			}
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/gopxl/beep"
+)
+
+// How much the volume keys change the volume
+const VOLUME_STEP_DB = 2
+
+// Range of the volume
+const (
+	MIN_VOLUME_DB = -60
+	MAX_VOLUME_DB = 20
+)
+
+// Samples louder than this are compressed, so that amplified audio doesn't clip harshly
+const SOFT_CLIP_THRESHOLD = 0.8
+
+// The volume of the audio output, in decibels relative to the volume of the file.
+// It is changed by the controller and read by the speaker goroutine.
+type Volume struct {
+	db    float64
+	muted bool
+	mu    sync.Mutex
+}
+
+func NewVolume(db float64, muted bool) *Volume {
+	return &Volume{
+		db:    min(max(db, MIN_VOLUME_DB), MAX_VOLUME_DB),
+		muted: muted,
+	}
+}
+
+// Changes the volume by `deltaDB` decibels and unmutes
+func (v *Volume) Change(deltaDB float64) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.db = min(max(v.db+deltaDB, MIN_VOLUME_DB), MAX_VOLUME_DB)
+	v.muted = false
+}
+
+func (v *Volume) ToggleMute() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.muted = !v.muted
+}
+
+// Returns the factor the samples are multiplied with
+func (v *Volume) gain() float64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.muted {
+		return 0
+	}
+	return math.Pow(10, v.db/20)
+}
+
+// Returns a description of the volume for the user
+func (v *Volume) String() string {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.muted {
+		return "Muted"
+	}
+	return fmt.Sprintf("Volume: %+.0f dB", v.db)
+}
+
+// Compresses samples above `SOFT_CLIP_THRESHOLD`, so that the output stays within [-1, 1]
+func softClip(sample float64) float64 {
+	magnitude := math.Abs(sample)
+	if magnitude <= SOFT_CLIP_THRESHOLD {
+		return sample
+	}
+	// tanh has a slope of 1 at 0, so the curve continues smoothly from the linear part
+	headroom := 1 - SOFT_CLIP_THRESHOLD
+	compressed := SOFT_CLIP_THRESHOLD + headroom*math.Tanh((magnitude-SOFT_CLIP_THRESHOLD)/headroom)
+	return math.Copysign(compressed, sample)
+}
+
+// Applies the volume to the samples of another streamer
+type volumeStreamer struct {
+	streamer beep.Streamer
+	volume   *Volume
+}
+
+func (v *volumeStreamer) Stream(samples [][2]float64) (n int, ok bool) {
+	n, ok = v.streamer.Stream(samples)
+
+	gain := v.volume.gain()
+	if gain == 1 {
+		return n, ok
+	}
+	// Only amplified audio can exceed the range, quieter audio is left undistorted
+	if gain < 1 {
+		for i := range samples[:n] {
+			samples[i][0] *= gain
+			samples[i][1] *= gain
+		}
+		return n, ok
+	}
+	for i := range samples[:n] {
+		samples[i][0] = softClip(samples[i][0] * gain)
+		samples[i][1] = softClip(samples[i][1] * gain)
+	}
+	return n, ok
+}
+
+func (v *volumeStreamer) Err() error {
+	return v.streamer.Err()
+}